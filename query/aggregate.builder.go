@@ -8,6 +8,8 @@ import (
 
 	"github.com/duolacloud/crud-core/types"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
 )
 
 type AggregateFunc string
@@ -20,18 +22,70 @@ const (
 	AggregateFuncMIN   AggregateFunc = "MIN"
 )
 
-var AGG_REGEXP = regexp.MustCompile("(AVG|SUM|COUNT|MAX|MIN|GROUP_BY|avg|sum|count|max|min|group_by)_(.*)")
+var AGG_REGEXP = regexp.MustCompile("(?i)^(AVG|SUM|COUNT|MAX|MIN|GROUP_BY)_(.*)$")
 
+// ConvertToAggregateResponse 按列别名解析聚合结果, 关联字段的别名无法还原, 使用 AggregateColumns.Convert
 func ConvertToAggregateResponse(aggregates []map[string]any) ([]*types.AggregateResponse, error) {
+	return AggregateColumns(nil).Convert(aggregates)
+}
+
+func extractResponse(response map[string]any, columns AggregateColumns) (*types.AggregateResponse, error) {
+	if response == nil {
+		return &types.AggregateResponse{}, nil
+	}
+
+	agg := &types.AggregateResponse{}
+
+	for resultField, value := range response {
+		if column, ok := columns[resultField]; ok {
+			agg.Append(column.Func, column.Field, value)
+			continue
+		}
+
+		matchResult := AGG_REGEXP.FindStringSubmatch(resultField)
+		if len(matchResult) != 3 {
+			return nil, fmt.Errorf("unknown aggregate column encountered for %s", resultField)
+		}
+
+		agg.Append(strings.ToUpper(matchResult[1]), matchResult[2], value)
+	}
+
+	return agg, nil
+}
+
+const nestedAliasSplit = "__"
+
+// aggregateColumnsKey AggregateBuilder.Build 生成的 AggregateColumns 保存在 gorm 的 Settings 中
+const aggregateColumnsKey = "crud:aggregate_columns"
+
+// AggregateColumn 聚合结果列对应的聚合函数和字段, 分组列的 Func 为 GROUP_BY
+type AggregateColumn struct {
+	Func  string
+	Field string
+}
+
+// AggregateColumns 聚合查询的列别名到字段的映射, 在构建查询时生成
+type AggregateColumns map[string]AggregateColumn
+
+// AggregateColumnsOf 返回 BuildAggregateQuery 构建的查询的列映射
+func AggregateColumnsOf(db *gorm.DB) AggregateColumns {
+	if value, ok := db.Get(aggregateColumnsKey); ok {
+		columns, _ := value.(AggregateColumns)
+		return columns
+	}
+	return nil
+}
+
+func (c AggregateColumns) Convert(aggregates []map[string]any) ([]*types.AggregateResponse, error) {
 	r := make([]*types.AggregateResponse, len(aggregates))
 	for i, aggregate := range aggregates {
 		ar := &types.AggregateResponse{}
 
-		agg, err := extractResponse(aggregate)
-		ar.Merge(agg)
+		agg, err := extractResponse(aggregate, c)
 		if err != nil {
 			return nil, err
 		}
+		ar.Merge(agg)
 
 		r[i] = ar
 	}
@@ -39,35 +93,22 @@ func ConvertToAggregateResponse(aggregates []map[string]any) ([]*types.Aggregate
 	return r, nil
 }
 
-func extractResponse(response map[string]any) (*types.AggregateResponse, error) {
-	if response == nil {
-		return &types.AggregateResponse{}, nil
-	}
-
-	agg := &types.AggregateResponse{}
-
-	for resultField /*, v*/ := range response {
-		resultField = strings.ToUpper(resultField)
-		matchResult := AGG_REGEXP.FindAllStringSubmatch(resultField, -1)
-
-		if len(matchResult[0]) != 3 {
-			return nil, fmt.Errorf("unknown aggregate column encountered for %s", resultField)
+// add 记录列别名, 不同字段生成相同别名时追加序号
+func (c AggregateColumns) add(alias string, fn string, field string) string {
+	unique := alias
+	for i := 2; ; i++ {
+		if _, ok := c[unique]; !ok {
+			break
 		}
-
-		matchedFunc := matchResult[0][1]
-		matchedFieldName := matchResult[0][2]
-
-		aggFunc := matchedFunc // camelCase(matchedFunc.toLowerCase())
-		fieldName := matchedFieldName
-
-		agg.Append(aggFunc, fieldName, response[resultField])
+		unique = fmt.Sprintf("%s_%d", alias, i)
 	}
 
-	return agg, nil
+	c[unique] = AggregateColumn{Func: fn, Field: field}
+	return unique
 }
 
 type ColumnPair struct {
-	Column string
+	Column clause.Expression
 	Alias  string
 }
 
@@ -77,16 +118,22 @@ type aggregatePayload struct {
 }
 
 type AggregateBuilder struct {
+	schema *schema.Schema
 }
 
 func NewAggregateBuilder() *AggregateBuilder {
 	return &AggregateBuilder{}
 }
 
+func newSchemaAggregateBuilder(s *schema.Schema) *AggregateBuilder {
+	return &AggregateBuilder{schema: s}
+}
+
 func (b *AggregateBuilder) Build(db *gorm.DB, aggregate *types.AggregateQuery, alias string) (*gorm.DB, error) {
 	var totalColumns []ColumnPair
+	aggregateColumns := AggregateColumns{}
 
-	columns, err := b.createGroupBySelect(db, aggregate.GroupBy, alias)
+	columns, err := b.createGroupBySelect(aggregateColumns, aggregate.GroupBy, alias)
 	if err != nil {
 		return nil, err
 	}
@@ -105,10 +152,6 @@ func (b *AggregateBuilder) Build(db *gorm.DB, aggregate *types.AggregateQuery, a
 			Fn:     AggregateFuncAVG,
 			Fields: aggregate.Avg,
 		},
-		{
-			Fn:     AggregateFuncAVG,
-			Fields: aggregate.Avg,
-		},
 		{
 			Fn:     AggregateFuncMAX,
 			Fields: aggregate.Max,
@@ -120,7 +163,10 @@ func (b *AggregateBuilder) Build(db *gorm.DB, aggregate *types.AggregateQuery, a
 	}
 
 	for _, aggregator := range aggregators {
-		columns, _ = b.createAggSelect(db, aggregator.Fn, aggregator.Fields, alias)
+		columns, err = b.createAggSelect(aggregateColumns, aggregator.Fn, aggregator.Fields, alias)
+		if err != nil {
+			return nil, err
+		}
 		totalColumns = append(totalColumns, columns...)
 	}
 
@@ -128,26 +174,17 @@ func (b *AggregateBuilder) Build(db *gorm.DB, aggregate *types.AggregateQuery, a
 		return nil, errors.New("no aggregate fields found")
 	}
 
-	/*
-		const [head, ...tail] = selects
-		return tail.reduce(
-			(acc: Qb, [select, selectAlias]) => acc.addSelect(select, selectAlias),
-			qb.select(head[0], head[1]),
-		);
-	*/
-
-	var selects []string
-	for _, column := range totalColumns {
-		sel := fmt.Sprintf("%s AS %s", column.Column, column.Alias)
-		selects = append(selects, sel)
+	selects := make([]clause.Expression, len(totalColumns))
+	for i, column := range totalColumns {
+		selects[i] = clause.Expr{SQL: "? AS ?", Vars: []any{column.Column, clause.Column{Name: column.Alias}}}
 	}
 
-	db = db.Select(selects)
+	db = db.Clauses(clause.Select{Expression: clause.CommaExpression{Exprs: selects}})
 
-	return db, nil
+	return db.Set(aggregateColumnsKey, aggregateColumns), nil
 }
 
-func (b *AggregateBuilder) createGroupBySelect(db *gorm.DB, fields []string, alias string) ([]ColumnPair, error) {
+func (b *AggregateBuilder) createGroupBySelect(aggregateColumns AggregateColumns, fields []string, alias string) ([]ColumnPair, error) {
 	var columns []ColumnPair
 
 	if len(fields) == 0 {
@@ -155,20 +192,21 @@ func (b *AggregateBuilder) createGroupBySelect(db *gorm.DB, fields []string, ali
 	}
 
 	for _, field := range fields {
-		if len(alias) > 0 {
-			field = fmt.Sprintf("%s.%s", alias, field)
+		column, err := b.resolveColumn(field, alias)
+		if err != nil {
+			return nil, err
 		}
 
 		columns = append(columns, ColumnPair{
-			Column: field,
-			Alias:  getGroupByAlias(field),
+			Column: clause.Expr{SQL: "?", Vars: []any{column}},
+			Alias:  aggregateColumns.add(getGroupByAlias(field), "GROUP_BY", field),
 		})
 	}
 
 	return columns, nil
 }
 
-func (b *AggregateBuilder) createAggSelect(db *gorm.DB, fn AggregateFunc, fields []string, alias string) ([]ColumnPair, error) {
+func (b *AggregateBuilder) createAggSelect(aggregateColumns AggregateColumns, fn AggregateFunc, fields []string, alias string) ([]ColumnPair, error) {
 	var columns []ColumnPair
 
 	if len(fields) == 0 {
@@ -176,24 +214,41 @@ func (b *AggregateBuilder) createAggSelect(db *gorm.DB, fn AggregateFunc, fields
 	}
 
 	for _, field := range fields {
-		aggregateAlias := getAggregateAlias(fn, field)
-		if len(alias) > 0 {
-			field = fmt.Sprintf("%s.%s", alias, field)
+		column, err := b.resolveColumn(field, alias)
+		if err != nil {
+			return nil, err
 		}
 
 		columns = append(columns, ColumnPair{
-			Column: fmt.Sprintf("%s(%s)", fn, field),
-			Alias:  aggregateAlias,
+			Column: clause.Expr{SQL: fmt.Sprintf("%s(?)", fn), Vars: []any{column}},
+			Alias:  aggregateColumns.add(getAggregateAlias(fn, field), string(fn), field),
 		})
 	}
 
 	return columns, nil
 }
 
+// resolveColumn 按 schema 校验字段, 未指定 schema 时只做标识符转义
+func (b *AggregateBuilder) resolveColumn(field string, alias string) (clause.Column, error) {
+	if len(alias) > 0 {
+		field = fmt.Sprintf("%s.%s", alias, field)
+	}
+
+	if b.schema == nil {
+		return clause.Column{Name: field}, nil
+	}
+
+	resolved, err := resolveField(b.schema, field)
+	if err != nil {
+		return clause.Column{}, err
+	}
+	return resolved.column, nil
+}
+
 func getAggregateAlias(fn AggregateFunc, field string) string {
-	return fmt.Sprintf("%s_%s", fn, field)
+	return fmt.Sprintf("%s_%s", fn, strings.ReplaceAll(field, ".", nestedAliasSplit))
 }
 
 func getGroupByAlias(field string) string {
-	return fmt.Sprintf("GROUP_BY_%s", field)
+	return fmt.Sprintf("GROUP_BY_%s", strings.ReplaceAll(field, ".", nestedAliasSplit))
 }
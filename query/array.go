@@ -0,0 +1,335 @@
+package query
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"gorm.io/gorm/clause"
+)
+
+// ArrayValue postgres 数组, 作为一个参数绑定, 避免 gorm 将 slice 展开为 (?,?)
+// pgx 通过 pgtype.ArrayGetter, pgtype.ArraySetter 按数组类型编解码, 其他驱动使用数组字面量如 {"a","b"}
+type ArrayValue []any
+
+// NewArrayValue value 为 slice 或者 array, 其他值作为只有一个元素的数组
+func NewArrayValue(value any) ArrayValue {
+	if _, ok := value.([]byte); ok {
+		return ArrayValue{value}
+	}
+	if values := sliceValues(value); values != nil {
+		return values
+	}
+	return ArrayValue{value}
+}
+
+func (a ArrayValue) Value() (driver.Value, error) {
+	if a == nil {
+		return nil, nil
+	}
+
+	var sb strings.Builder
+	if err := writeArrayLiteral(&sb, a); err != nil {
+		return nil, err
+	}
+	return sb.String(), nil
+}
+
+// Scan 解析数组字面量, 元素为 string, NULL 为 nil, 多维数组的元素为 []any
+func (a *ArrayValue) Scan(src any) error {
+	var literal string
+	switch v := src.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case string:
+		literal = v
+	case []byte:
+		literal = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into ArrayValue", src)
+	}
+
+	// 下标不从 1 开始时带有维度, 如 [0:1]={a,b}
+	if strings.HasPrefix(literal, "[") {
+		if i := strings.Index(literal, "="); i >= 0 {
+			literal = literal[i+1:]
+		}
+	}
+
+	values, rest, err := parseArrayLiteral(literal)
+	if err != nil {
+		return err
+	}
+	if len(strings.TrimSpace(rest)) > 0 {
+		return fmt.Errorf("invalid array literal %q", literal)
+	}
+	*a = values
+	return nil
+}
+
+// Dimensions 多维数组的各维长度按第一个元素计算, nil 为 NULL
+func (a ArrayValue) Dimensions() []pgtype.ArrayDimension {
+	if a == nil {
+		return nil
+	}
+
+	dimensions := []pgtype.ArrayDimension{}
+	var values []any = a
+	for {
+		dimensions = append(dimensions, pgtype.ArrayDimension{Length: int32(len(values)), LowerBound: 1})
+		if len(values) == 0 {
+			return dimensions
+		}
+		if _, ok := values[0].([]byte); ok {
+			return dimensions
+		}
+		if values = sliceValues(values[0]); values == nil {
+			return dimensions
+		}
+	}
+}
+
+// Index 多维数组按行展开后的第 i 个元素
+func (a ArrayValue) Index(i int) any {
+	if len(a.Dimensions()) == 1 {
+		return a[i]
+	}
+	return a.flatten()[i]
+}
+
+func (a ArrayValue) IndexType() any {
+	return nil
+}
+
+func (a ArrayValue) flatten() []any {
+	var values []any
+	for _, value := range a {
+		if _, ok := value.([]byte); !ok {
+			if nested := sliceValues(value); nested != nil {
+				values = append(values, ArrayValue(nested).flatten()...)
+				continue
+			}
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// SetDimensions pgx 扫描时多维数组按行展开
+func (a *ArrayValue) SetDimensions(dimensions []pgtype.ArrayDimension) error {
+	if dimensions == nil {
+		*a = nil
+		return nil
+	}
+
+	length := 1
+	for _, dimension := range dimensions {
+		length *= int(dimension.Length)
+	}
+	if len(dimensions) == 0 {
+		length = 0
+	}
+	*a = make(ArrayValue, length)
+	return nil
+}
+
+func (a ArrayValue) ScanIndex(i int) any {
+	return &a[i]
+}
+
+func (a ArrayValue) ScanIndexType() any {
+	return new(any)
+}
+
+// parseArrayLiteral 解析 {...}, 返回剩余的字符串
+func parseArrayLiteral(s string) ([]any, string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") {
+		return nil, s, fmt.Errorf("invalid array literal %q expected {", s)
+	}
+	s = strings.TrimSpace(s[1:])
+
+	values := []any{}
+	if strings.HasPrefix(s, "}") {
+		return values, s[1:], nil
+	}
+
+	for {
+		var value any
+		var err error
+		if strings.HasPrefix(s, "{") {
+			value, s, err = parseArrayLiteral(s)
+		} else {
+			value, s, err = parseArrayElement(s)
+		}
+		if err != nil {
+			return nil, s, err
+		}
+		values = append(values, value)
+
+		s = strings.TrimSpace(s)
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = strings.TrimSpace(s[1:])
+		case strings.HasPrefix(s, "}"):
+			return values, s[1:], nil
+		default:
+			return nil, s, fmt.Errorf("invalid array literal expected , or } got %q", s)
+		}
+	}
+}
+
+// parseArrayElement 双引号内以及 \ 之后的字符按原样取值, 没有双引号的 NULL 为 nil
+func parseArrayElement(s string) (any, string, error) {
+	var sb strings.Builder
+	quoted, inQuotes := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			i++
+			if i == len(s) {
+				return nil, "", fmt.Errorf("invalid array literal, unterminated escape")
+			}
+			sb.WriteByte(s[i])
+		case c == '"':
+			quoted, inQuotes = true, !inQuotes
+		case quoted && !inQuotes && (c == ' ' || c == '\t' || c == '\n'):
+			// 双引号之后的空白
+		case !inQuotes && (c == ',' || c == '}'):
+			element := sb.String()
+			if !quoted {
+				element = strings.TrimSpace(element)
+				if strings.EqualFold(element, "NULL") {
+					return nil, s[i:], nil
+				}
+			}
+			return element, s[i:], nil
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return nil, "", fmt.Errorf("invalid array literal, missing }")
+}
+
+func writeArrayLiteral(sb *strings.Builder, values []any) error {
+	sb.WriteByte('{')
+	for i, value := range values {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+
+		if _, ok := value.([]byte); !ok {
+			if nested := sliceValues(value); nested != nil {
+				if err := writeArrayLiteral(sb, nested); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if valuer, ok := value.(driver.Valuer); ok {
+			v, err := valuer.Value()
+			if err != nil {
+				return err
+			}
+			value = v
+		}
+
+		switch v := value.(type) {
+		case nil:
+			sb.WriteString("NULL")
+		case string:
+			writeArrayElement(sb, v)
+		case []byte:
+			writeArrayElement(sb, string(v))
+		case time.Time:
+			writeArrayElement(sb, v.Format(time.RFC3339Nano))
+		case fmt.Stringer:
+			writeArrayElement(sb, v.String())
+		default:
+			writeArrayElement(sb, fmt.Sprint(v))
+		}
+	}
+	sb.WriteByte('}')
+	return nil
+}
+
+// writeArrayElement 元素统一加双引号, 转义 \ 和 "
+func writeArrayElement(sb *strings.Builder, value string) {
+	sb.WriteByte('"')
+	sb.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value))
+	sb.WriteByte('"')
+}
+
+// arrayColumn 普通字段的列名需要转换为 clause.Column, 作为 clause.Expr 的参数时才会按列名输出
+func arrayColumn(operator string, operand Operand) (any, error) {
+	if len(operand.Dialect) > 0 && operand.Dialect != "postgres" {
+		return nil, fmt.Errorf("operator %s is only supported on postgres", operator)
+	}
+
+	if column, ok := operand.Column.(string); ok {
+		return clause.Column{Name: column}, nil
+	}
+	return operand.Column, nil
+}
+
+func arrayExpression(operator string, sql string) OperatorFunc {
+	return func(operand Operand, value any) (clause.Expression, error) {
+		column, err := arrayColumn(operator, operand)
+		if err != nil {
+			return nil, err
+		}
+		return clause.Expr{SQL: sql, Vars: []any{column, NewArrayValue(value)}}, nil
+	}
+}
+
+// arrayOperators postgres 数组列的操作符, 如 {"tags": {"arrayContains": ["a", "b"]}}
+var arrayOperators = map[string]OperatorFunc{
+	"arraycontains":    arrayExpression("arrayContains", "? @> ?"),
+	"arraycontainedby": arrayExpression("arrayContainedBy", "? <@ ?"),
+	"arrayoverlaps":    arrayExpression("arrayOverlaps", "? && ?"),
+	// arrayLength: 2 或者 {"gte": 2}, 空数组的长度为 0
+	"arraylength": func(operand Operand, value any) (clause.Expression, error) {
+		column, err := arrayColumn("arrayLength", operand)
+		if err != nil {
+			return nil, err
+		}
+
+		length := Operand{
+			Column:  clause.Expr{SQL: "cardinality(?)", Vars: []any{column}},
+			Field:   operand.Field,
+			Dialect: operand.Dialect,
+		}
+
+		cmp, ok := value.(map[string]any)
+		if !ok {
+			return defaultOperators["eq"](length, value)
+		}
+
+		var expressions []clause.Expression
+		for _, name := range []string{"eq", "neq", "gt", "gte", "lt", "lte"} {
+			if v, ok := cmp[name]; ok {
+				expression, err := defaultOperators[name](length, v)
+				if err != nil {
+					return nil, err
+				}
+				expressions = append(expressions, expression)
+			}
+		}
+		if len(expressions) != len(cmp) {
+			return nil, fmt.Errorf("invalid value for arrayLength expected a number or {eq, neq, gt, gte, lt, lte} got %v", value)
+		}
+		return clause.And(expressions...), nil
+	},
+	"anyeq": func(operand Operand, value any) (clause.Expression, error) {
+		column, err := arrayColumn("anyEq", operand)
+		if err != nil {
+			return nil, err
+		}
+		return clause.Expr{SQL: "? = ANY(?)", Vars: []any{value, column}}, nil
+	},
+}
@@ -0,0 +1,54 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrUnknownField = errors.New("unknown field")
+
+// UnknownFieldError 排序, 分组, 聚合等引用了 schema 中不存在的字段,
+// 可以通过 errors.Is(err, ErrUnknownField) 判断
+type UnknownFieldError struct {
+	Field string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("unknown field %s", e.Field)
+}
+
+func (e *UnknownFieldError) Is(target error) bool {
+	return target == ErrUnknownField
+}
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// FilterError 过滤条件的结构或者操作符的值不合法, Path 为出错的位置, 如 filter.or[2].age, filter.or[1].age.between,
+// 可以通过 errors.Is(err, ErrInvalidFilter) 判断
+type FilterError struct {
+	Path    string
+	Message string
+	// Err 操作符返回的原始错误
+	Err error
+}
+
+// wrapFilterError 操作符返回的错误加上路径, 已经是 FilterError 时保持不变
+func wrapFilterError(path string, err error) error {
+	var filterErr *FilterError
+	if errors.As(err, &filterErr) {
+		return err
+	}
+	return &FilterError{Path: path, Message: err.Error(), Err: err}
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("invalid filter at %s: %s", e.Path, e.Message)
+}
+
+func (e *FilterError) Is(target error) bool {
+	return target == ErrInvalidFilter
+}
+
+func (e *FilterError) Unwrap() error {
+	return e.Err
+}
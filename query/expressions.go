@@ -0,0 +1,262 @@
+package query
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// dialectName 返回生成 sql 时使用的数据库方言, 如 postgres, mysql, sqlite
+func dialectName(builder clause.Builder) string {
+	if stmt, ok := builder.(*gorm.Statement); ok && stmt.Dialector != nil {
+		return stmt.Dialector.Name()
+	}
+	return ""
+}
+
+func writeLower(builder clause.Builder, column any) {
+	builder.WriteString("LOWER(")
+	builder.WriteQuoted(column)
+	builder.WriteByte(')')
+}
+
+func addLowerVar(builder clause.Builder, value any) {
+	builder.WriteString("LOWER(")
+	builder.AddVar(builder, value)
+	builder.WriteByte(')')
+}
+
+// ILike 大小写不敏感的 LIKE, postgres 使用 ILIKE, 其他数据库使用 LOWER(column) LIKE LOWER(value)
+type ILike struct {
+	Column any
+	Value  any
+}
+
+func (like ILike) Build(builder clause.Builder) {
+	like.build(builder, false)
+}
+
+func (like ILike) NegationBuild(builder clause.Builder) {
+	like.build(builder, true)
+}
+
+func (like ILike) build(builder clause.Builder, not bool) {
+	writeLike(builder, like.Column, like.Value, true, not)
+}
+
+// writeLike fold 为 true 时大小写不敏感
+func writeLike(builder clause.Builder, column any, value any, fold bool, not bool) {
+	if !fold {
+		builder.WriteQuoted(column)
+		if not {
+			builder.WriteString(" NOT")
+		}
+		builder.WriteString(" LIKE ")
+		builder.AddVar(builder, value)
+		return
+	}
+
+	if dialectName(builder) == "postgres" {
+		builder.WriteQuoted(column)
+		if not {
+			builder.WriteString(" NOT")
+		}
+		builder.WriteString(" ILIKE ")
+		builder.AddVar(builder, value)
+		return
+	}
+
+	writeLower(builder, column)
+	if not {
+		builder.WriteString(" NOT")
+	}
+	builder.WriteString(" LIKE ")
+	addLowerVar(builder, value)
+}
+
+// EqFold 大小写不敏感的等于, LOWER(column) = LOWER(value)
+type EqFold struct {
+	Column any
+	Value  any
+}
+
+func (eq EqFold) Build(builder clause.Builder) {
+	writeLower(builder, eq.Column)
+	builder.WriteString(" = ")
+	addLowerVar(builder, eq.Value)
+}
+
+func (eq EqFold) NegationBuild(builder clause.Builder) {
+	writeLower(builder, eq.Column)
+	builder.WriteString(" <> ")
+	addLowerVar(builder, eq.Value)
+}
+
+// InFold 大小写不敏感的 IN, LOWER(column) IN (LOWER(value1), LOWER(value2) ...)
+type InFold struct {
+	Column any
+	Values []any
+}
+
+func (in InFold) Build(builder clause.Builder) {
+	in.build(builder, false)
+}
+
+func (in InFold) NegationBuild(builder clause.Builder) {
+	in.build(builder, true)
+}
+
+func (in InFold) build(builder clause.Builder, not bool) {
+	// 空列表与 clause.IN 一致, IN (NULL) 不匹配任何记录, 取反时为 IS NOT NULL
+	if len(in.Values) == 0 {
+		builder.WriteQuoted(in.Column)
+		if not {
+			builder.WriteString(" IS NOT NULL")
+		} else {
+			builder.WriteString(" IN (NULL)")
+		}
+		return
+	}
+
+	writeLower(builder, in.Column)
+	if not {
+		builder.WriteString(" NOT")
+	}
+
+	builder.WriteString(" IN (")
+	for i, value := range in.Values {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		addLowerVar(builder, value)
+	}
+	builder.WriteByte(')')
+}
+
+// Is column IS NULL / IS TRUE / IS FALSE, Value 只能是 nil 或者 bool
+type Is struct {
+	Column any
+	Value  any
+}
+
+func (is Is) Build(builder clause.Builder) {
+	is.build(builder, false)
+}
+
+func (is Is) NegationBuild(builder clause.Builder) {
+	is.build(builder, true)
+}
+
+func (is Is) build(builder clause.Builder, not bool) {
+	builder.WriteQuoted(is.Column)
+	builder.WriteString(" IS ")
+	if not {
+		builder.WriteString("NOT ")
+	}
+
+	switch is.Value {
+	case true:
+		builder.WriteString("TRUE")
+	case false:
+		builder.WriteString("FALSE")
+	default:
+		builder.WriteString("NULL")
+	}
+}
+
+type MatchMode int
+
+const (
+	MatchContains MatchMode = iota
+	MatchStartsWith
+	MatchEndsWith
+)
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// EscapeLike 转义 LIKE 的通配符 % 和 _, 转义字符为 \
+func EscapeLike(value string) string {
+	return likeEscaper.Replace(value)
+}
+
+// Match 包含, 前缀, 后缀匹配, Value 中的通配符按普通字符处理, Fold 为 true 时大小写不敏感
+type Match struct {
+	Column any
+	Value  string
+	Mode   MatchMode
+	Fold   bool
+}
+
+func (match Match) Build(builder clause.Builder) {
+	match.build(builder, false)
+}
+
+func (match Match) NegationBuild(builder clause.Builder) {
+	match.build(builder, true)
+}
+
+func (match Match) build(builder clause.Builder, not bool) {
+	pattern := EscapeLike(match.Value)
+	switch match.Mode {
+	case MatchStartsWith:
+		pattern = pattern + "%"
+	case MatchEndsWith:
+		pattern = "%" + pattern
+	default:
+		pattern = "%" + pattern + "%"
+	}
+
+	writeLike(builder, match.Column, pattern, match.Fold, not)
+
+	// mysql 字符串中的 \ 本身需要转义
+	if dialectName(builder) == "mysql" {
+		builder.WriteString(` ESCAPE '\\'`)
+	} else {
+		builder.WriteString(` ESCAPE '\'`)
+	}
+}
+
+// Regex 正则匹配, postgres 使用 ~ 和 ~*, mysql 和 sqlite 使用 REGEXP
+// Fold 为 true 时大小写不敏感, mysql 和 sqlite 通过在 Pattern 前加上 (?i) 实现, mysql 下 Fold 为 false 时是否区分大小写取决于排序规则
+type Regex struct {
+	Column  any
+	Pattern string
+	Fold    bool
+}
+
+func (regex Regex) Build(builder clause.Builder) {
+	regex.build(builder, false)
+}
+
+func (regex Regex) NegationBuild(builder clause.Builder) {
+	regex.build(builder, true)
+}
+
+func (regex Regex) build(builder clause.Builder, not bool) {
+	builder.WriteQuoted(regex.Column)
+
+	if dialectName(builder) == "postgres" {
+		builder.WriteByte(' ')
+		if not {
+			builder.WriteByte('!')
+		}
+		builder.WriteByte('~')
+		if regex.Fold {
+			builder.WriteByte('*')
+		}
+		builder.WriteByte(' ')
+		builder.AddVar(builder, regex.Pattern)
+		return
+	}
+
+	if not {
+		builder.WriteString(" NOT")
+	}
+	builder.WriteString(" REGEXP ")
+	if regex.Fold {
+		builder.AddVar(builder, "(?i)"+regex.Pattern)
+	} else {
+		builder.AddVar(builder, regex.Pattern)
+	}
+}
@@ -2,6 +2,8 @@ package query
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -9,32 +11,54 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 	"gorm.io/gorm/schema"
+	"gorm.io/gorm/utils"
 )
 
 type FilterQueryBuilder struct {
 	schema           *schema.Schema
 	whereBuilder     *WhereBuilder
 	aggregateBuilder *AggregateBuilder
+	policy           *fieldPolicy
+	registry         *OperatorRegistry
+	searchConfig     string
+	searchFieldNames []string
 }
 
-func NewFilterQueryBuilder(schema *schema.Schema) *FilterQueryBuilder {
+func NewFilterQueryBuilder(schema *schema.Schema, opts ...FilterQueryBuilderOption) *FilterQueryBuilder {
+	var _opts FilterQueryBuilderOptions
+	for _, o := range opts {
+		o(&_opts)
+	}
+
 	return &FilterQueryBuilder{
 		schema:           schema,
-		whereBuilder:     NewWhereBuilder(),
-		aggregateBuilder: NewAggregateBuilder(),
+		whereBuilder:     newSchemaWhereBuilder(schema, &_opts),
+		aggregateBuilder: newSchemaAggregateBuilder(schema),
+		policy:           newFieldPolicy(schema, &_opts),
+		registry:         _opts.OperatorRegistry,
+		searchConfig:     _opts.SearchConfig,
+		searchFieldNames: _opts.SearchFields,
 	}
 }
 
 func (b *FilterQueryBuilder) BuildQuery(q *types.PageQuery, db *gorm.DB) (*gorm.DB, error) {
-	// relation join
-	hasRelations := b.filterHasRelations(q.Filter)
+	filter, err := b.normalizeFilter(q.Filter)
+	if err != nil {
+		return nil, err
+	}
 
-	if hasRelations {
-		db = b.applyRelationJoinsRecursive(db, b.getReferencedRelationsRecursive(b.schema, q.Filter), "")
+	if err := b.checkFields(b.schema, nil, b.policy.sortable, FieldUsageSort, q.Sort...); err != nil {
+		return nil, err
+	}
+
+	// relation join
+	db, err = b.applyRelationJoins(db, filter, q.Sort...)
+	if err != nil {
+		return nil, err
 	}
 
 	// filter
-	db, err := b.applyFilter(db, q.Filter)
+	db, err = b.applyFilter(db, filter)
 	if err != nil {
 		return nil, err
 	}
@@ -45,28 +69,55 @@ func (b *FilterQueryBuilder) BuildQuery(q *types.PageQuery, db *gorm.DB) (*gorm.
 		return nil, err
 	}
 
+	// projection
+	db, err = b.BuildProjection(q.Fields, db)
+	if err != nil {
+		return nil, err
+	}
+
 	// paging
 	db, err = b.applyPaging(db, q.Page)
 	return db, err
 }
 
 func (b *FilterQueryBuilder) BuildCursorQuery(q *types.CursorQuery, db *gorm.DB) (*gorm.DB, error) {
-	// relation join
-	hasRelations := b.filterHasRelations(q.Filter)
+	filter, err := b.normalizeFilter(q.Filter)
+	if err != nil {
+		return nil, err
+	}
 
-	if hasRelations {
-		db = b.applyRelationJoinsRecursive(db, b.getReferencedRelationsRecursive(b.schema, q.Filter), "")
+	// relation join
+	db, err = b.applyRelationJoins(db, filter)
+	if err != nil {
+		return nil, err
 	}
 
 	// filter
-	db, err := b.applyFilter(db, q.Filter)
+	db, err = b.applyFilter(db, filter)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := b.checkFields(b.schema, nil, b.policy.sortable, FieldUsageSort, q.Sort...); err != nil {
+		return nil, err
+	}
+
 	// 追加主键排序，防止数据重复
 	b.ensureOrders(q)
 
+	// 游标取自记录本身的字段, 不支持按关联字段排序
+	sortColumns := make([]string, 0, len(q.Sort))
+	for _, sortField := range q.Sort {
+		field, err := resolveField(b.schema, strings.TrimLeft(sortField, "+-"))
+		if err != nil {
+			return nil, err
+		}
+		if len(field.relations) > 0 {
+			return nil, fmt.Errorf("cursor query can not sort by relation field %s", sortField)
+		}
+		sortColumns = append(sortColumns, field.field.DBName)
+	}
+
 	// 游标过滤
 	db, err = b.buildCursorFilter(db, q)
 	if err != nil {
@@ -79,21 +130,113 @@ func (b *FilterQueryBuilder) BuildCursorQuery(q *types.CursorQuery, db *gorm.DB)
 		return nil, err
 	}
 
+	// projection, 生成游标需要排序字段的值
+	if len(q.Fields) > 0 {
+		fields := append(append([]string{}, q.Fields...), sortColumns...)
+
+		db, err = b.BuildProjection(fields, db)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	limit := q.Limit + 1
 	db = db.Limit(int(limit))
 
 	return db, nil
 }
 
+// BuildMutationQuery 构建 update / delete 的过滤条件
+// update / delete 语句不支持 join, 关联过滤通过主键子查询实现
+func (b *FilterQueryBuilder) BuildMutationQuery(filter map[string]any, db *gorm.DB) (*gorm.DB, error) {
+	filter, err := b.normalizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if !b.filterHasRelations(filter) {
+		return b.applyFilter(db, filter)
+	}
+
+	subQuery := db.Session(&gorm.Session{NewDB: true}).Model(reflect.New(b.schema.ModelType).Interface())
+	// NewDB 不会保留 Unscoped, 硬删除时子查询也要包含软删除的记录
+	if db.Statement.Unscoped {
+		subQuery = subQuery.Unscoped()
+	}
+	subQuery, err = b.applyRelationJoins(subQuery, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	subQuery, err = b.applyFilter(subQuery, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	primaryColumns := make([]any, len(b.schema.PrimaryFieldDBNames))
+	placeholders := make([]string, len(b.schema.PrimaryFieldDBNames))
+	for i, pkField := range b.schema.PrimaryFieldDBNames {
+		primaryColumns[i] = clause.Column{Table: b.schema.Table, Name: pkField}
+		placeholders[i] = "?"
+	}
+	subQuery = subQuery.Select(strings.Join(placeholders, ","), primaryColumns...)
+
+	// 包一层派生表, 避免 mysql 不允许在子查询中引用被修改的表
+	return db.Where(clause.Expr{
+		SQL:  fmt.Sprintf("(%s) IN (SELECT * FROM (?) AS ?)", strings.Join(placeholders, ",")),
+		Vars: append(primaryColumns, subQuery, clause.Table{Name: "mutation_pks"}),
+	}), nil
+}
+
+// BuildProjection 只查询 fields 指定的列, 字段名与排序相同, 可以是列名或者结构体字段名
+func (b *FilterQueryBuilder) BuildProjection(fields []string, db *gorm.DB) (*gorm.DB, error) {
+	if len(fields) == 0 {
+		return db, nil
+	}
+
+	columns := make([]clause.Column, 0, len(fields))
+	selected := map[string]bool{}
+	for _, field := range fields {
+		// 支持带表名前缀, 如 users.name
+		resolved, err := resolveField(b.schema, field)
+		if err != nil {
+			return nil, err
+		}
+		if len(resolved.relations) > 0 {
+			return nil, fmt.Errorf("projection can not select relation field %s", field)
+		}
+		schemaField := resolved.field
+
+		if selected[schemaField.DBName] {
+			continue
+		}
+		selected[schemaField.DBName] = true
+
+		columns = append(columns, clause.Column{Table: b.schema.Table, Name: schemaField.DBName})
+	}
+
+	// 直接指定 SELECT 子句, 避免 gorm 追加 join 关联的列
+	return db.Clauses(clause.Select{Columns: columns}), nil
+}
+
 func (b *FilterQueryBuilder) applyFilter(db *gorm.DB, filter map[string]any) (*gorm.DB, error) {
 	if filter == nil {
 		return db, nil
 	}
 
+	if err := b.checkFilter(b.schema, nil, filter); err != nil {
+		return nil, err
+	}
+
 	// j, _ := json.Marshal(b.getReferencedRelationsRecursive(b.schema, filter))
 	// fmt.Printf("b.getReferencedRelationsRecursive(b.schema, filter): %v\n", string(j))
 
-	expression, err := b.whereBuilder.build(filter, b.getReferencedRelationsRecursive(b.schema, filter), "")
+	whereBuilder := b.whereBuilder
+	if db.Dialector != nil {
+		whereBuilder = whereBuilder.withDialect(db.Dialector.Name())
+	}
+
+	expression, err := whereBuilder.build(filter, b.getReferencedRelationsRecursive(b.schema, filter), "", filterPath)
 	if err != nil {
 		return nil, err
 	}
@@ -105,27 +248,47 @@ func (b *FilterQueryBuilder) applyFilter(db *gorm.DB, filter map[string]any) (*g
 	return db, nil
 }
 
+// applyRelationJoins join 过滤条件以及 fields (排序, 分组, 聚合字段) 引用的关联
+func (b *FilterQueryBuilder) applyRelationJoins(db *gorm.DB, filter map[string]any, fields ...string) (*gorm.DB, error) {
+	relations := b.getReferencedRelationsRecursive(b.schema, filter)
+
+	for _, field := range fields {
+		resolved, err := resolveField(b.schema, strings.TrimLeft(field, "+-"))
+		if err != nil {
+			return nil, err
+		}
+		joinFieldRelations(relations, resolved)
+	}
+
+	return b.applyRelationJoinsRecursive(db, relations, ""), nil
+}
+
 func (b *FilterQueryBuilder) applyRelationJoinsRecursive(db *gorm.DB, relationsMap map[string]any, alias string) *gorm.DB {
 	if relationsMap == nil {
 		return db
 	}
 
+	// 排序保证生成的 sql 稳定
+	relations := make([]string, 0, len(relationsMap))
 	for relation := range relationsMap {
+		relations = append(relations, relation)
+	}
+	sort.Strings(relations)
+
+	for _, relation := range relations {
 		subRelationsMap := relationsMap[relation].(map[string]any)
 
 		if len(alias) > 0 {
 			relation = fmt.Sprintf("%s.%s", alias, relation)
 		}
 
-		// fmt.Printf("join relation: %v\n", relation)
+		// 多级关联 A.B 由 gorm 依次 join A 和 A.B, 别名分别为 A 和 A__B
+		if len(subRelationsMap) == 0 {
+			db = db.Joins(relation)
+			continue
+		}
 
-		// TODO 目前 join 无法完成 多级关联
-		return b.applyRelationJoinsRecursive(
-			db.Joins(relation),
-			// db.Joins(relation),
-			subRelationsMap,
-			relation,
-		)
+		db = b.applyRelationJoinsRecursive(db, subRelationsMap, relation)
 	}
 
 	return db
@@ -135,48 +298,126 @@ func (b *FilterQueryBuilder) getReferencedRelationsRecursive(schema *schema.Sche
 	relationMap := map[string]any{}
 
 	for filterField, filterValue := range filter {
-		if filterField == "and" || filterField == "or" {
-			if subFilters, ok := filterValue.([]map[string]any); ok {
-				for _, subFilter := range subFilters {
-					subRelations := b.getReferencedRelationsRecursive(schema, subFilter)
-					for key, subRelation := range subRelations {
-						relationMap[key] = subRelation
-					}
-				}
+		if isCombinator(filterField) {
+			for _, subFilter := range combinatorFilters(filterValue) {
+				subRelations := b.getReferencedRelationsRecursive(schema, subFilter)
+				mergeRelations(relationMap, subRelations)
 			}
 		} else {
-			relationMetadata, ok := schema.Relationships.Relations[filterField]
+			relationMetadata, ok := lookupRelation(schema, filterField)
 
-			if !ok {
+			// 集合关联通过 EXISTS 子查询过滤, 不需要 join
+			if !ok || isCollectionRelation(relationMetadata) {
 				continue
 			}
 
-			var mmm map[string]any
-			if relationMap[filterField] != nil {
-				mmm = relationMap[filterField].(map[string]any)
-			}
-
-			if mmm == nil {
-				mmm = map[string]any{}
-			}
-
 			filterValue1, ok := filterValue.(map[string]any)
 			if !ok {
 				continue
 			}
 
 			subFilter := b.getReferencedRelationsRecursive(relationMetadata.FieldSchema, filterValue1)
-			// fmt.Printf("relationMetadata.Schema: %v, %v, %v\n", relationMetadata.FieldSchema, filterValue1, subFilter)
-			for k, v := range subFilter {
-				mmm[k] = v
-			}
-			relationMap[filterField] = mmm
+			mergeRelations(relationMap, map[string]any{relationMetadata.Name: subFilter})
 		}
 	}
 
 	return relationMap
 }
 
+// mergeRelations 将 src 中的关联合并到 dst, 同一个关联在多个条件中出现时合并其子关联
+func mergeRelations(dst map[string]any, src map[string]any) {
+	for relation, subRelations := range src {
+		existing, ok := dst[relation].(map[string]any)
+		if !ok {
+			dst[relation] = subRelations
+			continue
+		}
+		mergeRelations(existing, subRelations.(map[string]any))
+	}
+}
+
+// fieldPath 解析后的字段, relations 为字段所在的关联路径, 需要 join
+type fieldPath struct {
+	column    clause.Column
+	field     *schema.Field
+	relations []string
+}
+
+// resolveField 按 schema 解析字段路径, 支持 field, table.field, Relation.field, Relation.SubRelation.field
+// 字段名可以是列名或者结构体字段名, 关联只支持 belongs to 和 has one
+func resolveField(s *schema.Schema, path string) (*fieldPath, error) {
+	segments := strings.Split(path, ".")
+	if len(segments) > 1 && segments[0] == s.Table {
+		if _, ok := lookupRelation(s, segments[0]); !ok {
+			segments = segments[1:]
+		}
+	}
+
+	resolved := &fieldPath{}
+	table := s.Table
+	current := s
+	for _, segment := range segments[:len(segments)-1] {
+		relation, ok := lookupRelation(current, segment)
+		if !ok || isCollectionRelation(relation) {
+			return nil, &UnknownFieldError{Field: path}
+		}
+
+		if len(resolved.relations) == 0 {
+			table = relation.Name
+		} else {
+			table = utils.NestedRelationName(table, relation.Name)
+		}
+		resolved.relations = append(resolved.relations, relation.Name)
+		current = relation.FieldSchema
+	}
+
+	field := current.LookUpField(segments[len(segments)-1])
+	if field == nil || len(field.DBName) == 0 {
+		return nil, &UnknownFieldError{Field: path}
+	}
+
+	resolved.field = field
+	resolved.column = clause.Column{Table: table, Name: field.DBName}
+	return resolved, nil
+}
+
+func (f *fieldPath) key() string {
+	return strings.Join(append(append([]string{}, f.relations...), f.field.DBName), ".")
+}
+
+// joinFieldRelations 将字段所在的关联合并到需要 join 的关联中
+func joinFieldRelations(relationsMap map[string]any, fields ...*fieldPath) {
+	for _, field := range fields {
+		relations := relationsMap
+		for _, relation := range field.relations {
+			subRelations, ok := relations[relation].(map[string]any)
+			if !ok {
+				subRelations = map[string]any{}
+				relations[relation] = subRelations
+			}
+			relations = subRelations
+		}
+	}
+}
+
+func isCollectionRelation(relation *schema.Relationship) bool {
+	return relation.Type == schema.HasMany || relation.Type == schema.Many2Many
+}
+
+// lookupRelation 按名称查找关联, 名称不区分大小写
+func lookupRelation(s *schema.Schema, name string) (*schema.Relationship, bool) {
+	if relation, ok := s.Relationships.Relations[name]; ok {
+		return relation, true
+	}
+
+	for relationName, relation := range s.Relationships.Relations {
+		if strings.EqualFold(relationName, name) {
+			return relation, true
+		}
+	}
+	return nil, false
+}
+
 func (b *FilterQueryBuilder) filterHasRelations(filter map[string]any) bool {
 	if filter == nil {
 		return false
@@ -193,8 +434,12 @@ func (b *FilterQueryBuilder) getReferencedRelations(filter map[string]any) []str
 	var referencedRelations []string
 
 	for _, relation := range relations {
+		if isCollectionRelation(relation) {
+			continue
+		}
+
 		for _, referencedField := range referencedFields {
-			if relation.Name == referencedField {
+			if strings.EqualFold(relation.Name, referencedField) {
 				referencedRelations = append(referencedRelations, relation.Name)
 			}
 		}
@@ -207,13 +452,10 @@ func (b *FilterQueryBuilder) getFilterFields(filter map[string]any) []string {
 	fieldMap := map[string]bool{}
 
 	for filterField, fieldValue := range filter {
-		if filterField == "and" || filterField == "or" {
-			if fieldValue != nil {
-				if subFilter, ok := fieldValue.(map[string]any); ok {
-					subFields := b.getFilterFields(subFilter)
-					for _, subField := range subFields {
-						fieldMap[subField] = true
-					}
+		if isCombinator(filterField) {
+			for _, subFilter := range combinatorFilters(fieldValue) {
+				for _, subField := range b.getFilterFields(subFilter) {
+					fieldMap[subField] = true
 				}
 			}
 		} else {
@@ -231,23 +473,14 @@ func (b *FilterQueryBuilder) getFilterFields(filter map[string]any) []string {
 
 func (b *FilterQueryBuilder) applySorting(db *gorm.DB, sort []string) (*gorm.DB, error) {
 	for _, sortField := range sort {
-		isDesc := false
-		if sortField[0:1] == "-" {
-			sortField = sortField[1:]
-			isDesc = true
-		}
-
-		if sortField[0:1] == "+" {
-			sortField = sortField[1:]
-			isDesc = false
-		}
+		sortField, isDesc := parseSortField(sortField)
 
-		if !strings.Contains(sortField, ".") {
-			// add table name to sort field, avoiding ambiguous column error
-			sortField = strings.Join([]string{b.schema.Table, sortField}, ".")
+		field, err := resolveField(b.schema, sortField)
+		if err != nil {
+			return nil, err
 		}
 
-		db = db.Order(clause.OrderByColumn{Column: clause.Column{Name: sortField}, Desc: isDesc})
+		db = db.Order(clause.OrderByColumn{Column: field.column, Desc: isDesc})
 	}
 
 	return db, nil
@@ -337,7 +570,7 @@ func (b *FilterQueryBuilder) buildCursorFilter(db *gorm.DB, query *types.CursorQ
 		return nil, fmt.Errorf("cursor format fields length: %d not match orders fields length: %d", len(cursor.Value), len(query.Sort))
 	}
 
-	fields := make([]string, len(cursor.Value))
+	fields := make([]clause.Column, len(cursor.Value))
 	values := make([]any, len(cursor.Value))
 	isDescs := make([]bool, len(cursor.Value))
 
@@ -354,19 +587,14 @@ func (b *FilterQueryBuilder) buildCursorFilter(db *gorm.DB, query *types.CursorQ
 			sortField = sortField[1:]
 		}
 
-		// trim maybe existed tablename prefix
-		baseFieldName := sortField
-		if strings.Contains(baseFieldName, ".") {
-			baseFieldName = strings.Split(baseFieldName, ".")[1]
-		}
-		field, ok := b.schema.FieldsByDBName[baseFieldName]
-		if !ok {
-			return nil, fmt.Errorf("ERR_DB_UNKNOWN_FIELD %s", baseFieldName)
+		resolved, err := resolveField(b.schema, sortField)
+		if err != nil {
+			return nil, err
 		}
-		fields[i] = sortField
+		fields[i] = resolved.column
 		isDescs[i] = isDesc
 
-		switch field.DataType {
+		switch resolved.field.DataType {
 		case "time":
 			switch v := value.(type) {
 			case int64:
@@ -420,13 +648,30 @@ func (b *FilterQueryBuilder) buildCursorFilter(db *gorm.DB, query *types.CursorQ
 }
 
 func (b *FilterQueryBuilder) BuildAggregateQuery(db *gorm.DB, aggregate *types.AggregateQuery, filter map[string]any) (*gorm.DB, error) {
-	hasRelations := b.filterHasRelations(filter)
+	filter, err := b.normalizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
 
-	if hasRelations {
-		db = b.applyRelationJoinsRecursive(db, b.getReferencedRelationsRecursive(b.schema, filter), "")
+	var fields []string
+	for _, aggregateFields := range [][]string{aggregate.GroupBy, aggregate.Count, aggregate.Sum, aggregate.Avg, aggregate.Max, aggregate.Min} {
+		fields = append(fields, aggregateFields...)
+	}
+
+	if err := b.checkFields(b.schema, nil, b.policy.groupable, FieldUsageGroupBy, aggregate.GroupBy...); err != nil {
+		return nil, err
 	}
 
-	db, err := b.applyAggregate(db, aggregate, "")
+	if err := b.checkFields(b.schema, nil, b.policy.aggregatable, FieldUsageAggregate, fields[len(aggregate.GroupBy):]...); err != nil {
+		return nil, err
+	}
+
+	db, err = b.applyRelationJoins(db, filter, fields...)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err = b.applyAggregate(db, aggregate, "")
 	if err != nil {
 		return nil, err
 	}
@@ -464,7 +709,12 @@ func (b *FilterQueryBuilder) applyGroupBy(db *gorm.DB, groupBy []string, alias s
 			group = fmt.Sprintf("%s.%s", alias, group)
 		}
 
-		db = db.Group(group)
+		field, err := resolveField(b.schema, group)
+		if err != nil {
+			return nil, err
+		}
+
+		db = db.Clauses(clause.GroupBy{Columns: []clause.Column{field.column}})
 	}
 
 	return db, nil
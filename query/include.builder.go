@@ -0,0 +1,233 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/duolacloud/crud-core/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const includeRowNumberColumn = "include_row_number"
+
+// Include 预加载的关联, Relation 支持多级路径, 如 organization.owner
+// Filter, Sort, Limit 作用于路径上最后一级关联
+type Include struct {
+	Relation string
+	Filter   map[string]any
+	Sort     []string
+	// Limit 每个父记录最多加载的条数, 只支持 has many 关联, 其他关联返回错误.
+	// gorm 预加载 many2many 时先查询 join table, 再将关联记录分配给所有关联的父记录, 无法按父记录限制条数
+	Limit int
+}
+
+// BuildIncludes 预加载 includes 指定的关联, 需要在 BuildQuery / BuildProjection 之后调用,
+// 指定了查询列时会补充预加载需要的关联键
+func (b *FilterQueryBuilder) BuildIncludes(includes []Include, db *gorm.DB) (*gorm.DB, error) {
+	var keyFields []*schema.Field
+
+	for i, include := range includes {
+		relations, err := b.resolveRelationPath(include.Relation)
+		if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, len(relations))
+		for i, relation := range relations {
+			names[i] = relation.Name
+		}
+
+		relation := relations[len(relations)-1]
+		if include.Filter != nil {
+			include.Filter, err = normalizeFilterValue(relation.FieldSchema, include.Filter, fmt.Sprintf("includes[%d].%s", i, filterPath))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if err := b.checkFilter(relation.FieldSchema, names, include.Filter); err != nil {
+			return nil, err
+		}
+
+		if err := b.checkFields(relation.FieldSchema, names, b.policy.sortable, FieldUsageSort, include.Sort...); err != nil {
+			return nil, err
+		}
+
+		// 没有排序白名单时同样需要检查排序字段, 空字段名不作为默认排序
+		for _, sortField := range include.Sort {
+			sortField, _ := parseSortField(sortField)
+			if len(sortField) == 0 {
+				return nil, fmt.Errorf("include %s: empty sort field", include.Relation)
+			}
+			if _, err := resolveField(relation.FieldSchema, sortField); err != nil {
+				return nil, err
+			}
+		}
+
+		preload, err := b.preloadFunc(relation, include)
+		if err != nil {
+			return nil, err
+		}
+
+		db = db.Preload(strings.Join(names, "."), preload)
+		keyFields = append(keyFields, relationKeyFields(relations[0])...)
+	}
+
+	return b.appendProjectionFields(db, keyFields), nil
+}
+
+// resolveRelationPath 按 schema 逐级查找关联, 名称不区分大小写
+func (b *FilterQueryBuilder) resolveRelationPath(path string) ([]*schema.Relationship, error) {
+	var relations []*schema.Relationship
+
+	current := b.schema
+	for _, name := range strings.Split(path, ".") {
+		relation, ok := lookupRelation(current, name)
+		if !ok {
+			return nil, fmt.Errorf("relation %s not found in %s", path, current.Name)
+		}
+
+		relations = append(relations, relation)
+		current = relation.FieldSchema
+	}
+
+	return relations, nil
+}
+
+func (b *FilterQueryBuilder) preloadFunc(relation *schema.Relationship, include Include) (func(tx *gorm.DB) *gorm.DB, error) {
+	if include.Limit > 0 && relation.Type == schema.Many2Many {
+		return nil, fmt.Errorf("include %s: limit is not supported on many2many relations, preloaded records are shared by all parents in the join table", include.Relation)
+	}
+
+	if include.Limit > 0 && relation.Type != schema.HasMany {
+		return nil, fmt.Errorf("include %s: limit is only supported on has many relations", include.Relation)
+	}
+
+	builder := NewFilterQueryBuilder(relation.FieldSchema, WithOperatorRegistry(b.registry), WithSearchConfig(b.searchConfig))
+	q := &types.PageQuery{Filter: include.Filter, Sort: include.Sort}
+
+	if include.Limit <= 0 {
+		return func(tx *gorm.DB) *gorm.DB {
+			db, err := builder.BuildQuery(q, tx)
+			if err != nil {
+				tx.AddError(err)
+				return tx
+			}
+			return db
+		}, nil
+	}
+
+	// 每个父记录只取前 Limit 条: 按外键分区编号, 派生表沿用原表名, 外层的外键条件可以下推到子查询
+	var partitionColumns []any
+	for _, ref := range relation.References {
+		if ref.OwnPrimaryKey {
+			partitionColumns = append(partitionColumns, clause.Column{Table: relation.FieldSchema.Table, Name: ref.ForeignKey.DBName})
+		}
+	}
+
+	orderBy := clause.OrderBy{}
+	sort := include.Sort
+	if len(sort) == 0 {
+		sort = relation.FieldSchema.PrimaryFieldDBNames
+	}
+	for _, sortField := range sort {
+		sortField, desc := parseSortField(sortField)
+		field, err := resolveField(relation.FieldSchema, sortField)
+		if err != nil {
+			return nil, err
+		}
+		if len(field.relations) > 0 {
+			return nil, fmt.Errorf("include %s: limit can not be combined with relation sort field %s", include.Relation, sortField)
+		}
+		orderBy.Columns = append(orderBy.Columns, clause.OrderByColumn{Column: field.column, Desc: desc})
+	}
+
+	return func(tx *gorm.DB) *gorm.DB {
+		subQuery := tx.Session(&gorm.Session{NewDB: true}).Model(reflect.New(relation.FieldSchema.ModelType).Interface())
+		subQuery, err := builder.applyRelationJoins(subQuery, include.Filter)
+		if err != nil {
+			tx.AddError(err)
+			return tx
+		}
+
+		subQuery, err = builder.applyFilter(subQuery, include.Filter)
+		if err != nil {
+			tx.AddError(err)
+			return tx
+		}
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(partitionColumns)), ",")
+		subQuery = subQuery.Select(
+			fmt.Sprintf("?.*, ROW_NUMBER() OVER (PARTITION BY %s ?) AS ?", placeholders),
+			append(append([]any{clause.Table{Name: relation.FieldSchema.Table}}, partitionColumns...), orderBy, clause.Column{Name: includeRowNumberColumn})...,
+		)
+
+		db := tx.Table(fmt.Sprintf("(?) AS %s", relation.FieldSchema.Table), subQuery).
+			Where(clause.Lte{Column: clause.Column{Name: includeRowNumberColumn}, Value: include.Limit})
+
+		db, err = builder.applySorting(db, include.Sort)
+		if err != nil {
+			tx.AddError(err)
+			return tx
+		}
+		return db
+	}, nil
+}
+
+// relationKeyFields 返回预加载关联时父记录需要的列
+func relationKeyFields(relation *schema.Relationship) []*schema.Field {
+	var fields []*schema.Field
+	for _, ref := range relation.References {
+		if ref.OwnPrimaryKey {
+			fields = append(fields, ref.PrimaryKey)
+		} else if len(ref.PrimaryValue) == 0 && relation.JoinTable == nil {
+			fields = append(fields, ref.ForeignKey)
+		}
+	}
+	return fields
+}
+
+// appendProjectionFields 在 BuildProjection 指定的列之外追加 fields
+func (b *FilterQueryBuilder) appendProjectionFields(db *gorm.DB, fields []*schema.Field) *gorm.DB {
+	c, ok := db.Statement.Clauses["SELECT"]
+	if !ok {
+		return db
+	}
+
+	selectClause, ok := c.Expression.(clause.Select)
+	if !ok || len(selectClause.Columns) == 0 {
+		return db
+	}
+
+	columns := append([]clause.Column{}, selectClause.Columns...)
+	for _, field := range fields {
+		selected := false
+		for _, column := range columns {
+			if column.Name == field.DBName {
+				selected = true
+				break
+			}
+		}
+
+		if !selected {
+			columns = append(columns, clause.Column{Table: b.schema.Table, Name: field.DBName})
+		}
+	}
+
+	selectClause.Columns = columns
+	return db.Clauses(selectClause)
+}
+
+// parseSortField 去掉 +, - 前缀, - 为降序
+func parseSortField(sortField string) (string, bool) {
+	switch {
+	case strings.HasPrefix(sortField, "-"):
+		return sortField[1:], true
+	case strings.HasPrefix(sortField, "+"):
+		return sortField[1:], false
+	}
+	return sortField, false
+}
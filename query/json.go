@@ -0,0 +1,521 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+func isJSONField(field *schema.Field) bool {
+	switch strings.ToLower(string(field.DataType)) {
+	case "json", "jsonb":
+		return true
+	}
+	return false
+}
+
+// lookupJSONPath 字段路径的第一段为 json 字段时返回该字段以及之后的路径, 如 meta.address.city
+func lookupJSONPath(s *schema.Schema, path string) (*schema.Field, []string, bool) {
+	segments := strings.Split(path, ".")
+	if len(segments) < 2 {
+		return nil, nil, false
+	}
+
+	field := s.LookUpField(segments[0])
+	if field == nil || len(field.DBName) == 0 || !isJSONField(field) {
+		return nil, nil, false
+	}
+	return field, segments[1:], true
+}
+
+// sqlJSONPath mysql, sqlite 的 json 路径, 如 $."address"."city", 数字作为数组下标
+func sqlJSONPath(path []string) string {
+	var sb strings.Builder
+	sb.WriteByte('$')
+	for _, segment := range path {
+		if isArrayIndex(segment) {
+			sb.WriteString("[" + segment + "]")
+			continue
+		}
+		sb.WriteString(`."`)
+		sb.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(segment))
+		sb.WriteByte('"')
+	}
+	return sb.String()
+}
+
+func isArrayIndex(segment string) bool {
+	if len(segment) == 0 {
+		return false
+	}
+	for _, c := range segment {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// writeTextArray CAST(ARRAY[?, ?] AS text[])
+func writeTextArray(builder clause.Builder, values []string) {
+	builder.WriteString("CAST(ARRAY[")
+	for i, value := range values {
+		if i > 0 {
+			builder.WriteString(", ")
+		}
+		builder.AddVar(builder, value)
+	}
+	builder.WriteString("] AS text[])")
+}
+
+func writeNot(builder clause.Builder, expression clause.Expression) {
+	builder.WriteString("NOT (")
+	expression.Build(builder)
+	builder.WriteByte(')')
+}
+
+// JSONValueType json 路径作为列比较时的取值类型
+type JSONValueType string
+
+const (
+	JSONText    JSONValueType = ""
+	JSONNumber  JSONValueType = "number"
+	JSONBoolean JSONValueType = "boolean"
+)
+
+// jsonTypedOperators 按比较值的类型取 json 值的操作符, 其余操作符如 like, isNull 仍按文本取值
+var jsonTypedOperators = map[string]bool{
+	"eq": true, "neq": true, "gt": true, "gte": true, "lt": true, "lte": true,
+	"in": true, "notin": true, "between": true, "notbetween": true,
+}
+
+// jsonValueType 比较值的类型, 列表取第一个元素, between 取 lower
+func jsonValueType(value any) JSONValueType {
+	switch v := value.(type) {
+	case bool:
+		return JSONBoolean
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, json.Number:
+		return JSONNumber
+	case string, []byte, nil:
+		return JSONText
+	case map[string]any:
+		return jsonValueType(v["lower"])
+	}
+
+	if values := sliceValues(value); len(values) > 0 {
+		return jsonValueType(values[0])
+	}
+	return JSONText
+}
+
+// typed json 路径字段按比较值的类型取值, 数字, 布尔值不按文本比较, 如 meta.score > 2
+func (o Operand) typed(operator string, value any) Operand {
+	if o.JSONPath == nil || !jsonTypedOperators[strings.ToLower(operator)] {
+		return o
+	}
+
+	valueType := jsonValueType(value)
+	if valueType == JSONText {
+		return o
+	}
+
+	path := *o.JSONPath
+	path.Type = valueType
+	o.Column = clause.Expr{SQL: "?", Vars: []any{path}}
+	return o
+}
+
+// JSONPath json 列 Column 中 Path 处的值, 作为列比较时默认按文本取值
+// postgres 使用 #>>, mysql 使用 JSON_UNQUOTE(JSON_EXTRACT()), sqlite 使用 JSON_EXTRACT()
+// Type 为数字或者布尔值时只取该类型的值, 其他类型的值为 NULL
+type JSONPath struct {
+	Column clause.Column
+	Path   []string
+	Type   JSONValueType
+}
+
+func (p JSONPath) Build(builder clause.Builder) {
+	if p.Type != JSONText {
+		p.buildTyped(builder)
+		return
+	}
+
+	switch dialectName(builder) {
+	case "postgres":
+		builder.WriteQuoted(p.Column)
+		builder.WriteString(" #>> ")
+		writeTextArray(builder, p.Path)
+	case "mysql":
+		builder.WriteString("JSON_UNQUOTE(")
+		p.writeExtract(builder, p.Path)
+		builder.WriteByte(')')
+	default:
+		p.writeExtract(builder, p.Path)
+	}
+}
+
+// buildTyped CASE WHEN 值的类型匹配 THEN 按类型取值 END
+// postgres 使用 jsonb_typeof 并 CAST, mysql 使用 JSON_TYPE, sqlite 的 JSON_EXTRACT 本身按类型取值
+func (p JSONPath) buildTyped(builder clause.Builder) {
+	builder.WriteString("CASE WHEN ")
+	switch dialectName(builder) {
+	case "postgres":
+		builder.WriteString("jsonb_typeof(")
+		p.buildValue(builder)
+		builder.WriteString(") = ")
+		builder.AddVar(builder, string(p.Type))
+		builder.WriteString(" THEN CAST(")
+		builder.WriteQuoted(p.Column)
+		builder.WriteString(" #>> ")
+		writeTextArray(builder, p.Path)
+		if p.Type == JSONNumber {
+			builder.WriteString(" AS numeric)")
+		} else {
+			builder.WriteString(" AS boolean)")
+		}
+	case "mysql":
+		builder.WriteString("JSON_TYPE(")
+		p.writeExtract(builder, p.Path)
+		if p.Type == JSONNumber {
+			builder.WriteString(") IN ('INTEGER', 'UNSIGNED INTEGER', 'DOUBLE', 'DECIMAL') THEN CAST(")
+			p.writeExtract(builder, p.Path)
+			builder.WriteString(" AS DECIMAL(65, 30))")
+		} else {
+			builder.WriteString(") = 'BOOLEAN' THEN ")
+			p.writeExtract(builder, p.Path)
+			builder.WriteString(" = CAST('true' AS JSON)")
+		}
+	default:
+		p.writeType(builder, p.Path)
+		if p.Type == JSONNumber {
+			builder.WriteString(" IN ('integer', 'real') THEN ")
+		} else {
+			builder.WriteString(" IN ('true', 'false') THEN ")
+		}
+		p.writeExtract(builder, p.Path)
+	}
+	builder.WriteString(" END")
+}
+
+// buildValue 按 json 取值, 没有路径时为 json 列本身
+func (p JSONPath) buildValue(builder clause.Builder) {
+	if len(p.Path) == 0 {
+		builder.WriteQuoted(p.Column)
+		return
+	}
+
+	if dialectName(builder) == "postgres" {
+		builder.WriteQuoted(p.Column)
+		builder.WriteString(" #> ")
+		writeTextArray(builder, p.Path)
+		return
+	}
+	p.writeExtract(builder, p.Path)
+}
+
+func (p JSONPath) writeExtract(builder clause.Builder, path []string) {
+	builder.WriteString("JSON_EXTRACT(")
+	builder.WriteQuoted(p.Column)
+	builder.WriteString(", ")
+	builder.AddVar(builder, sqlJSONPath(path))
+	builder.WriteByte(')')
+}
+
+// writeType sqlite JSON_TYPE(column, path), 路径不存在时为 NULL
+func (p JSONPath) writeType(builder clause.Builder, path []string) {
+	builder.WriteString("JSON_TYPE(")
+	builder.WriteQuoted(p.Column)
+	builder.WriteString(", ")
+	builder.AddVar(builder, sqlJSONPath(path))
+	builder.WriteByte(')')
+}
+
+func (p JSONPath) child(segments ...string) []string {
+	return append(append([]string{}, p.Path...), segments...)
+}
+
+// JSONContains json 值包含 Value, postgres 使用 @>, mysql 使用 JSON_CONTAINS
+// sqlite 没有对应的函数, 逐个比较 Value 中的叶子节点, 数组元素通过 JSON_EACH 查找
+type JSONContains struct {
+	Target JSONPath
+	Value  json.RawMessage
+}
+
+func (c JSONContains) Build(builder clause.Builder) {
+	switch dialectName(builder) {
+	case "postgres":
+		c.Target.buildValue(builder)
+		builder.WriteString(" @> CAST(")
+		builder.AddVar(builder, string(c.Value))
+		builder.WriteString(" AS jsonb)")
+	case "mysql":
+		builder.WriteString("JSON_CONTAINS(")
+		builder.WriteQuoted(c.Target.Column)
+		builder.WriteString(", ")
+		builder.AddVar(builder, string(c.Value))
+		if len(c.Target.Path) > 0 {
+			builder.WriteString(", ")
+			builder.AddVar(builder, sqlJSONPath(c.Target.Path))
+		}
+		builder.WriteByte(')')
+	default:
+		var value any
+		_ = json.Unmarshal(c.Value, &value)
+
+		builder.WriteByte('(')
+		c.buildLeaves(builder, c.Target.Path, value)
+		builder.WriteByte(')')
+	}
+}
+
+func (c JSONContains) NegationBuild(builder clause.Builder) {
+	writeNot(builder, c)
+}
+
+func (c JSONContains) buildLeaves(builder clause.Builder, path []string, value any) {
+	switch v := value.(type) {
+	case map[string]any:
+		if len(v) == 0 {
+			c.Target.writeType(builder, path)
+			builder.WriteString(" = 'object'")
+			return
+		}
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for i, key := range keys {
+			if i > 0 {
+				builder.WriteString(" AND ")
+			}
+			c.buildLeaves(builder, append(append([]string{}, path...), key), v[key])
+		}
+	case []any:
+		if len(v) == 0 {
+			c.Target.writeType(builder, path)
+			builder.WriteString(" = 'array'")
+			return
+		}
+
+		for i, element := range v {
+			if i > 0 {
+				builder.WriteString(" AND ")
+			}
+			builder.WriteString("EXISTS (SELECT 1 FROM JSON_EACH(")
+			builder.WriteQuoted(c.Target.Column)
+			builder.WriteString(", ")
+			builder.AddVar(builder, sqlJSONPath(path))
+			builder.WriteString(") AS json_elements WHERE ")
+			switch element.(type) {
+			case map[string]any, []any:
+				data, _ := json.Marshal(element)
+				builder.WriteString("JSON(json_elements.value) = JSON(")
+				builder.AddVar(builder, string(data))
+				builder.WriteByte(')')
+			case nil:
+				builder.WriteString("json_elements.type = 'null'")
+			default:
+				builder.WriteString("json_elements.value = ")
+				builder.AddVar(builder, element)
+			}
+			builder.WriteByte(')')
+		}
+	case nil:
+		c.Target.writeType(builder, path)
+		builder.WriteString(" = 'null'")
+	default:
+		c.Target.writeExtract(builder, path)
+		builder.WriteString(" = ")
+		builder.AddVar(builder, v)
+	}
+}
+
+// JSONHasKeys json 对象包含键, All 为 false 时包含任意一个即可
+// postgres 使用 jsonb_exists, jsonb_exists_any, jsonb_exists_all, 分别与 ?, ?|, ?& 操作符等价
+type JSONHasKeys struct {
+	Target JSONPath
+	Keys   []string
+	All    bool
+}
+
+func (h JSONHasKeys) Build(builder clause.Builder) {
+	switch dialectName(builder) {
+	case "postgres":
+		switch {
+		case len(h.Keys) == 1:
+			builder.WriteString("jsonb_exists(")
+		case h.All:
+			builder.WriteString("jsonb_exists_all(")
+		default:
+			builder.WriteString("jsonb_exists_any(")
+		}
+		h.Target.buildValue(builder)
+		builder.WriteString(", ")
+		if len(h.Keys) == 1 {
+			builder.AddVar(builder, h.Keys[0])
+		} else {
+			writeTextArray(builder, h.Keys)
+		}
+		builder.WriteByte(')')
+	case "mysql":
+		builder.WriteString("JSON_CONTAINS_PATH(")
+		builder.WriteQuoted(h.Target.Column)
+		if h.All {
+			builder.WriteString(", 'all'")
+		} else {
+			builder.WriteString(", 'one'")
+		}
+		for _, key := range h.Keys {
+			builder.WriteString(", ")
+			builder.AddVar(builder, sqlJSONPath(h.Target.child(key)))
+		}
+		builder.WriteByte(')')
+	default:
+		builder.WriteByte('(')
+		for i, key := range h.Keys {
+			if i > 0 {
+				if h.All {
+					builder.WriteString(" AND ")
+				} else {
+					builder.WriteString(" OR ")
+				}
+			}
+			h.Target.writeType(builder, h.Target.child(key))
+			builder.WriteString(" IS NOT NULL")
+		}
+		builder.WriteByte(')')
+	}
+}
+
+func (h JSONHasKeys) NegationBuild(builder clause.Builder) {
+	writeNot(builder, h)
+}
+
+// JSONPathExists json 值中存在 Query 匹配的元素, postgres 使用 jsonb_path_exists, 支持完整的 SQL/JSON path
+// mysql, sqlite 使用 JSON_EXTRACT(value, Query) IS NOT NULL, Query 只能使用各自支持的路径语法
+type JSONPathExists struct {
+	Target JSONPath
+	Query  string
+}
+
+func (e JSONPathExists) Build(builder clause.Builder) {
+	if dialectName(builder) == "postgres" {
+		builder.WriteString("jsonb_path_exists(")
+		e.Target.buildValue(builder)
+		builder.WriteString(", CAST(")
+		builder.AddVar(builder, e.Query)
+		builder.WriteString(" AS jsonpath))")
+		return
+	}
+
+	builder.WriteString("JSON_EXTRACT(")
+	e.Target.buildValue(builder)
+	builder.WriteString(", ")
+	builder.AddVar(builder, e.Query)
+	builder.WriteString(") IS NOT NULL")
+}
+
+func (e JSONPathExists) NegationBuild(builder clause.Builder) {
+	writeNot(builder, e)
+}
+
+// jsonTarget json 操作符作用的 json 值, 字段必须是 json 字段
+func jsonTarget(operator string, operand Operand) (JSONPath, error) {
+	if operand.JSONPath != nil {
+		return *operand.JSONPath, nil
+	}
+
+	column, ok := operand.Column.(string)
+	if !ok || operand.Field == nil || !isJSONField(operand.Field) {
+		return JSONPath{}, fmt.Errorf("operator %s requires a json field, got %v", operator, operand.Column)
+	}
+	return JSONPath{Column: clause.Column{Name: column}}, nil
+}
+
+func jsonKeys(operator string, value any) ([]string, error) {
+	values := sliceValues(value)
+	if len(values) == 0 {
+		return nil, fmt.Errorf("invalid value for %s expected a non-empty list of keys got %v", operator, value)
+	}
+
+	keys := make([]string, len(values))
+	for i, v := range values {
+		key, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid value for %s expected a list of strings got %v", operator, value)
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// jsonOperators 只用于 json 字段, 如 {"meta": {"hasKey": "address"}}, {"meta.address": {"jsonContains": {"city": "Paris"}}}
+var jsonOperators = map[string]OperatorFunc{
+	"jsoncontains": func(operand Operand, value any) (clause.Expression, error) {
+		target, err := jsonTarget("jsonContains", operand)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for jsonContains: %w", err)
+		}
+		return JSONContains{Target: target, Value: data}, nil
+	},
+	"haskey": func(operand Operand, value any) (clause.Expression, error) {
+		target, err := jsonTarget("hasKey", operand)
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid value for hasKey expected string got %v", value)
+		}
+		return JSONHasKeys{Target: target, Keys: []string{key}, All: true}, nil
+	},
+	"hasanykeys": func(operand Operand, value any) (clause.Expression, error) {
+		target, err := jsonTarget("hasAnyKeys", operand)
+		if err != nil {
+			return nil, err
+		}
+
+		keys, err := jsonKeys("hasAnyKeys", value)
+		if err != nil {
+			return nil, err
+		}
+		return JSONHasKeys{Target: target, Keys: keys}, nil
+	},
+	"hasallkeys": func(operand Operand, value any) (clause.Expression, error) {
+		target, err := jsonTarget("hasAllKeys", operand)
+		if err != nil {
+			return nil, err
+		}
+
+		keys, err := jsonKeys("hasAllKeys", value)
+		if err != nil {
+			return nil, err
+		}
+		return JSONHasKeys{Target: target, Keys: keys, All: true}, nil
+	},
+	"jsonpath": func(operand Operand, value any) (clause.Expression, error) {
+		target, err := jsonTarget("jsonPath", operand)
+		if err != nil {
+			return nil, err
+		}
+
+		query, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid value for jsonPath expected string got %v", value)
+		}
+		return JSONPathExists{Target: target, Query: query}, nil
+	},
+}
@@ -0,0 +1,126 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm/schema"
+)
+
+// filterPath 过滤条件在错误信息中的根路径
+const filterPath = "filter"
+
+// normalizeFilter 规范化顶层过滤条件, 为空时不过滤
+func (b *FilterQueryBuilder) normalizeFilter(filter map[string]any) (map[string]any, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	return normalizeFilterValue(b.schema, filter, filterPath)
+}
+
+// normalizeFilterValue 将 json 解码得到的过滤条件 (map[string]interface{}, []interface{} 等) 转换为 builder 使用的结构:
+// and, or 为 []map[string]any, not, 关联, 量词为 map[string]any, 字段为操作符到值的 map[string]any, 操作符的值保持不变
+// 结构不合法时返回带路径的 FilterError
+func normalizeFilterValue(s *schema.Schema, value any, path string) (map[string]any, error) {
+	return normalizeFilterMap(s, value, path, false)
+}
+
+// normalizeFilterMap quantifiers 为 true 时 value 为集合关联的过滤条件, 可以使用 some, every, none
+func normalizeFilterMap(s *schema.Schema, value any, path string, quantifiers bool) (map[string]any, error) {
+	filter, ok := toFilterMap(value)
+	if !ok {
+		return nil, &FilterError{Path: path, Message: fmt.Sprintf("expected an object, got %s", typeName(value))}
+	}
+
+	normalized := make(map[string]any, len(filter))
+	for key, value := range filter {
+		keyPath := path + "." + key
+
+		switch {
+		case key == "and" || key == "or":
+			list, ok := toFilterList(value)
+			if !ok {
+				return nil, &FilterError{Path: keyPath, Message: fmt.Sprintf("expected an array of filters, got %s", typeName(value))}
+			}
+
+			subFilters := make([]map[string]any, len(list))
+			for i, item := range list {
+				subFilter, err := normalizeFilterValue(s, item, fmt.Sprintf("%s[%d]", keyPath, i))
+				if err != nil {
+					return nil, err
+				}
+				subFilters[i] = subFilter
+			}
+			normalized[key] = subFilters
+		case key == "not" || (quantifiers && isQuantifier(key)):
+			subFilter, err := normalizeFilterValue(s, value, keyPath)
+			if err != nil {
+				return nil, err
+			}
+			normalized[key] = subFilter
+		default:
+			if s != nil {
+				if relation, ok := lookupRelation(s, key); ok {
+					subFilter, err := normalizeFilterMap(relation.FieldSchema, value, keyPath, isCollectionRelation(relation))
+					if err != nil {
+						return nil, err
+					}
+					normalized[key] = subFilter
+					continue
+				}
+			}
+
+			cmp, ok := toFilterMap(value)
+			if !ok {
+				return nil, &FilterError{Path: keyPath, Message: fmt.Sprintf("expected an object of operators, got %s", typeName(value))}
+			}
+			normalized[key] = cmp
+		}
+	}
+
+	return normalized, nil
+}
+
+// toFilterMap 接受任意 key 为字符串的 map
+func toFilterMap(value any) (map[string]any, bool) {
+	if m, ok := value.(map[string]any); ok {
+		return m, true
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+
+	m := make(map[string]any, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		m[iter.Key().String()] = iter.Value().Interface()
+	}
+	return m, true
+}
+
+// toFilterList 接受任意 slice 或 array
+func toFilterList(value any) ([]any, bool) {
+	if list, ok := value.([]any); ok {
+		return list, true
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+
+	list := make([]any, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list, true
+}
+
+func typeName(value any) string {
+	if value == nil {
+		return "null"
+	}
+	return reflect.TypeOf(value).String()
+}
@@ -0,0 +1,114 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Operand 操作符作用的字段
+type Operand struct {
+	// Column 普通字段为带表名或者关联别名的列名, 如 users.name, Owner__Organization.name
+	// json 路径字段为取值表达式, 如 meta.address.city
+	Column any
+	// Field schema 中的字段, 字段不在 schema 中时为 nil, json 路径字段为 json 列
+	Field *schema.Field
+	// Dialect 数据库方言, 如 postgres, mysql, sqlite
+	Dialect string
+	// JSONPath json 路径字段的 json 列以及路径, 普通字段为 nil
+	JSONPath *JSONPath
+	// SearchConfig 全文搜索的 text search configuration, 字段的 searchConfig 标签优先
+	SearchConfig string
+}
+
+type OperatorFunc func(operand Operand, value any) (clause.Expression, error)
+
+// OperatorRegistry 过滤操作符注册表, 操作符名称不区分大小写
+// 创建时复制默认操作符以及 DEFAULT_COMPARISON_MAP, 之后的注册只影响当前注册表
+type OperatorRegistry struct {
+	mu        sync.RWMutex
+	operators map[string]OperatorFunc
+}
+
+func NewOperatorRegistry() *OperatorRegistry {
+	return &OperatorRegistry{
+		operators: seedOperators(),
+	}
+}
+
+// Register 注册操作符, 同名时覆盖默认实现
+func (r *OperatorRegistry) Register(name string, fn OperatorFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.operators[strings.ToLower(name)] = fn
+}
+
+// RegisterExpression 注册只需要列名的操作符, 不支持 json 路径字段
+func (r *OperatorRegistry) RegisterExpression(name string, fn ExpressionFunc) {
+	r.Register(name, expressionOperator(name, fn))
+}
+
+func expressionOperator(name string, fn ExpressionFunc) OperatorFunc {
+	return func(operand Operand, value any) (clause.Expression, error) {
+		column, ok := operand.Column.(string)
+		if !ok {
+			return nil, fmt.Errorf("operator %s does not support json path fields", name)
+		}
+		return fn(column, value)
+	}
+}
+
+// Lookup registry 为 nil 时使用默认操作符
+func (r *OperatorRegistry) Lookup(name string) (OperatorFunc, bool) {
+	if r == nil {
+		r = NewOperatorRegistry()
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	fn, ok := r.operators[strings.ToLower(name)]
+	return fn, ok
+}
+
+func WithOperatorRegistry(registry *OperatorRegistry) FilterQueryBuilderOption {
+	return func(o *FilterQueryBuilderOptions) {
+		o.OperatorRegistry = registry
+	}
+}
+
+// seedOperators 默认操作符, 以及 DEFAULT_COMPARISON_MAP 中的操作符, 同名时 DEFAULT_COMPARISON_MAP 优先
+// DEFAULT_COMPARISON_MAP 的操作符只接收列名, json 路径字段仍然使用默认实现
+func seedOperators() map[string]OperatorFunc {
+	operators := map[string]OperatorFunc{}
+	for _, defaults := range []map[string]OperatorFunc{defaultOperators, jsonOperators, arrayOperators} {
+		for name, operator := range defaults {
+			operators[name] = operator
+		}
+	}
+
+	for name, expressionFunc := range DEFAULT_COMPARISON_MAP {
+		name = strings.ToLower(name)
+		operators[name] = columnOperator(name, expressionFunc, operators[name])
+	}
+	return operators
+}
+
+// columnOperator 普通列使用 fn, 其他字段使用 fallback, 没有 fallback 时返回错误
+func columnOperator(name string, fn ExpressionFunc, fallback OperatorFunc) OperatorFunc {
+	operator := expressionOperator(name, fn)
+	if fallback == nil {
+		return operator
+	}
+
+	return func(operand Operand, value any) (clause.Expression, error) {
+		if _, ok := operand.Column.(string); !ok {
+			return fallback(operand, value)
+		}
+		return operator(operand, value)
+	}
+}
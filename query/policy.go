@@ -0,0 +1,267 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm/schema"
+)
+
+// 字段的用途
+const (
+	FieldUsageFilter    = "filter"
+	FieldUsageSort      = "sort"
+	FieldUsageGroupBy   = "group by"
+	FieldUsageAggregate = "aggregate"
+)
+
+var ErrFieldNotAllowed = errors.New("field not allowed")
+
+// FieldPolicyError 字段或者操作符不在白名单中, 可以通过 errors.Is(err, ErrFieldNotAllowed) 判断
+type FieldPolicyError struct {
+	Field    string
+	Usage    string
+	Operator string
+}
+
+func (e *FieldPolicyError) Error() string {
+	if len(e.Operator) > 0 {
+		return fmt.Sprintf("operator %s is not allowed on field %s", e.Operator, e.Field)
+	}
+	return fmt.Sprintf("field %s is not allowed in %s", e.Field, e.Usage)
+}
+
+func (e *FieldPolicyError) Is(target error) bool {
+	return target == ErrFieldNotAllowed
+}
+
+// FilterQueryBuilderOptions 字段白名单, 为 nil 时不限制
+// 字段可以是列名, 结构体字段名, 或者关联字段路径, 如 owner.organization.name
+type FilterQueryBuilderOptions struct {
+	FilterableFields   []string
+	SortableFields     []string
+	FieldOperators     map[string][]string
+	GroupableFields    []string
+	AggregatableFields []string
+	// OperatorRegistry 过滤操作符, 为 nil 时使用默认操作符
+	OperatorRegistry *OperatorRegistry
+	// SearchConfig 全文搜索默认的 text search configuration, 如 english
+	SearchConfig string
+	// SearchFields BuildSearchQuery 搜索的字段
+	SearchFields []string
+}
+
+type FilterQueryBuilderOption func(*FilterQueryBuilderOptions)
+
+func WithFilterableFields(fields ...string) FilterQueryBuilderOption {
+	return func(o *FilterQueryBuilderOptions) {
+		o.FilterableFields = append(o.FilterableFields, fields...)
+	}
+}
+
+func WithSortableFields(fields ...string) FilterQueryBuilderOption {
+	return func(o *FilterQueryBuilderOptions) {
+		o.SortableFields = append(o.SortableFields, fields...)
+	}
+}
+
+// WithFieldOperators 限制字段可以使用的操作符, 未声明的字段不限制
+func WithFieldOperators(field string, operators ...string) FilterQueryBuilderOption {
+	return func(o *FilterQueryBuilderOptions) {
+		if o.FieldOperators == nil {
+			o.FieldOperators = map[string][]string{}
+		}
+		o.FieldOperators[field] = append(o.FieldOperators[field], operators...)
+	}
+}
+
+func WithGroupableFields(fields ...string) FilterQueryBuilderOption {
+	return func(o *FilterQueryBuilderOptions) {
+		o.GroupableFields = append(o.GroupableFields, fields...)
+	}
+}
+
+func WithAggregatableFields(fields ...string) FilterQueryBuilderOption {
+	return func(o *FilterQueryBuilderOptions) {
+		o.AggregatableFields = append(o.AggregatableFields, fields...)
+	}
+}
+
+// fieldPolicy 白名单按 schema 解析后的字段路径比较
+type fieldPolicy struct {
+	filterable   map[string]bool
+	sortable     map[string]bool
+	operators    map[string]map[string]bool
+	groupable    map[string]bool
+	aggregatable map[string]bool
+}
+
+func newFieldPolicy(s *schema.Schema, opts *FilterQueryBuilderOptions) *fieldPolicy {
+	policy := &fieldPolicy{
+		filterable:   fieldKeySet(s, opts.FilterableFields),
+		sortable:     fieldKeySet(s, opts.SortableFields),
+		groupable:    fieldKeySet(s, opts.GroupableFields),
+		aggregatable: fieldKeySet(s, opts.AggregatableFields),
+	}
+
+	if opts.FieldOperators != nil {
+		policy.operators = map[string]map[string]bool{}
+		for field, operators := range opts.FieldOperators {
+			set := map[string]bool{}
+			for _, operator := range operators {
+				set[strings.ToLower(operator)] = true
+			}
+			policy.operators[fieldKey(s, field)] = set
+		}
+	}
+
+	return policy
+}
+
+func fieldKeySet(s *schema.Schema, fields []string) map[string]bool {
+	if fields == nil {
+		return nil
+	}
+
+	set := map[string]bool{}
+	for _, field := range fields {
+		set[fieldKey(s, field)] = true
+	}
+	return set
+}
+
+// fieldKey 字段路径的规范形式, 如 Owner.Organization.name, 无法解析时原样返回
+// 与 resolveField 不同, 路径中可以包含集合关联
+func fieldKey(s *schema.Schema, path string) string {
+	segments := strings.Split(path, ".")
+	if len(segments) > 1 && segments[0] == s.Table {
+		if _, ok := lookupRelation(s, segments[0]); !ok {
+			segments = segments[1:]
+		}
+	}
+
+	var names []string
+	current := s
+	for _, segment := range segments[:len(segments)-1] {
+		relation, ok := lookupRelation(current, segment)
+		if !ok {
+			return path
+		}
+		names = append(names, relation.Name)
+		current = relation.FieldSchema
+	}
+
+	field := current.LookUpField(segments[len(segments)-1])
+	if field == nil || len(field.DBName) == 0 {
+		return path
+	}
+	return strings.Join(append(names, field.DBName), ".")
+}
+
+func (p *fieldPolicy) checkField(allowed map[string]bool, key string, field string, usage string) error {
+	if allowed == nil || allowed[key] {
+		return nil
+	}
+	return &FieldPolicyError{Field: field, Usage: usage}
+}
+
+func (p *fieldPolicy) checkOperator(key string, field string, operator string) error {
+	if p.operators == nil {
+		return nil
+	}
+
+	operators, ok := p.operators[key]
+	if !ok || operators[strings.ToLower(operator)] {
+		return nil
+	}
+	return &FieldPolicyError{Field: field, Usage: FieldUsageFilter, Operator: operator}
+}
+
+// checkFilter 校验过滤条件中的字段和操作符, relations 为 s 所在的关联路径
+func (b *FilterQueryBuilder) checkFilter(s *schema.Schema, relations []string, filter map[string]any) error {
+	if b.policy.filterable == nil && b.policy.operators == nil {
+		return nil
+	}
+
+	for key, value := range filter {
+		if isCombinator(key) {
+			for _, subFilter := range combinatorFilters(value) {
+				if err := b.checkFilter(s, relations, subFilter); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		cmp, _ := value.(map[string]any)
+
+		if relation, ok := lookupRelation(s, key); ok {
+			subRelations := append(append([]string{}, relations...), relation.Name)
+
+			subFilters := []map[string]any{cmp}
+			if isCollectionRelation(relation) {
+				if quantified := quantifiedFilters(cmp); len(quantified) > 0 {
+					subFilters = quantified
+				}
+			}
+
+			for _, subFilter := range subFilters {
+				if err := b.checkFilter(relation.FieldSchema, subRelations, subFilter); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		field := strings.Join(append(append([]string{}, relations...), key), ".")
+		// json 路径按其所在的 json 字段校验
+		schemaField := s.LookUpField(key)
+		if jsonField, _, ok := lookupJSONPath(s, key); schemaField == nil && ok {
+			schemaField = jsonField
+		}
+
+		canonical := field
+		if schemaField != nil && len(schemaField.DBName) > 0 {
+			canonical = strings.Join(append(append([]string{}, relations...), schemaField.DBName), ".")
+		}
+
+		if err := b.policy.checkField(b.policy.filterable, canonical, field, FieldUsageFilter); err != nil {
+			return err
+		}
+
+		for operator := range cmp {
+			if err := b.policy.checkOperator(canonical, field, operator); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkFields 校验排序, 分组, 聚合的字段, relations 为 s 所在的关联路径
+func (b *FilterQueryBuilder) checkFields(s *schema.Schema, relations []string, allowed map[string]bool, usage string, fields ...string) error {
+	if allowed == nil {
+		return nil
+	}
+
+	for _, field := range fields {
+		field = strings.TrimLeft(field, "+-")
+		resolved, err := resolveField(s, field)
+		if err != nil {
+			return err
+		}
+
+		key := resolved.key()
+		if len(relations) > 0 {
+			key = strings.Join(relations, ".") + "." + key
+		}
+
+		if err := b.policy.checkField(allowed, key, field, usage); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/duolacloud/crud-core/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// searchConfigTag 字段的 text search configuration, 如 gorm:"column:title;searchConfig:english"
+const searchConfigTag = "SEARCHCONFIG"
+
+var searchConfigRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// WithSearchConfig 默认的 text search configuration, 字段的 searchConfig 标签优先
+func WithSearchConfig(config string) FilterQueryBuilderOption {
+	return func(o *FilterQueryBuilderOptions) {
+		o.SearchConfig = config
+	}
+}
+
+// WithSearchFields BuildSearchQuery 搜索的字段, 未指定时使用带有 searchConfig 标签的字段
+func WithSearchFields(fields ...string) FilterQueryBuilderOption {
+	return func(o *FilterQueryBuilderOptions) {
+		o.SearchFields = append(o.SearchFields, fields...)
+	}
+}
+
+func fieldSearchConfig(field *schema.Field, defaultConfig string) string {
+	if field != nil {
+		if config := field.TagSettings[searchConfigTag]; len(config) > 0 {
+			return config
+		}
+	}
+	return defaultConfig
+}
+
+func checkSearchConfig(config string) error {
+	if len(config) > 0 && !searchConfigRegexp.MatchString(config) {
+		return fmt.Errorf("invalid text search configuration %s", config)
+	}
+	return nil
+}
+
+// SearchColumn 全文搜索的列, Config 为空时使用数据库的默认配置
+type SearchColumn struct {
+	Column any
+	Config string
+}
+
+// Search postgres 使用 to_tsvector(config, column) @@ websearch_to_tsquery(config, query), 多个列时合并各列的 tsvector
+// 其他数据库按空白拆分 Query, 每个词都需要出现在任意一列中, 使用大小写不敏感的 LIKE 匹配
+type Search struct {
+	Columns []SearchColumn
+	Query   string
+}
+
+func (s Search) Build(builder clause.Builder) {
+	if dialectName(builder) == "postgres" {
+		s.writeVector(builder)
+		builder.WriteString(" @@ ")
+		s.writeQuery(builder)
+		return
+	}
+
+	words := strings.Fields(s.Query)
+	if len(words) == 0 || len(s.Columns) == 0 {
+		builder.WriteString("1 = 0")
+		return
+	}
+
+	var expressions []clause.Expression
+	for _, word := range words {
+		var matches []clause.Expression
+		for _, column := range s.Columns {
+			matches = append(matches, Match{Column: column.Column, Value: word, Mode: MatchContains, Fold: true})
+		}
+		expressions = append(expressions, clause.Or(matches...))
+	}
+	clause.And(expressions...).Build(builder)
+}
+
+func (s Search) NegationBuild(builder clause.Builder) {
+	writeNot(builder, s)
+}
+
+func (s Search) writeVector(builder clause.Builder) {
+	for i, column := range s.Columns {
+		if i > 0 {
+			builder.WriteString(" || ")
+		}
+		builder.WriteString("to_tsvector(")
+		writeSearchConfig(builder, column.Config)
+		// 多个列时其中一列为 NULL 不影响其他列
+		if len(s.Columns) > 1 {
+			builder.WriteString("COALESCE(")
+			builder.WriteQuoted(column.Column)
+			builder.WriteString(", '')")
+		} else {
+			builder.WriteQuoted(column.Column)
+		}
+		builder.WriteByte(')')
+	}
+}
+
+// writeQuery 使用第一列的配置解析搜索词
+func (s Search) writeQuery(builder clause.Builder) {
+	builder.WriteString("websearch_to_tsquery(")
+	if len(s.Columns) > 0 {
+		writeSearchConfig(builder, s.Columns[0].Config)
+	}
+	builder.AddVar(builder, s.Query)
+	builder.WriteByte(')')
+}
+
+// writeSearchConfig 配置名以字面量输出, 与 to_tsvector('english', column) 这类表达式索引一致
+func writeSearchConfig(builder clause.Builder, config string) {
+	if len(config) == 0 {
+		return
+	}
+
+	if checkSearchConfig(config) == nil {
+		builder.WriteString("'" + config + "', ")
+		return
+	}
+
+	builder.WriteString("CAST(")
+	builder.AddVar(builder, config)
+	builder.WriteString(" AS regconfig), ")
+}
+
+// SearchRank ts_rank(tsvector, tsquery), 只用于 postgres
+type SearchRank struct {
+	Search Search
+}
+
+func (r SearchRank) Build(builder clause.Builder) {
+	builder.WriteString("ts_rank(")
+	r.Search.writeVector(builder)
+	builder.WriteString(", ")
+	r.Search.writeQuery(builder)
+	builder.WriteByte(')')
+}
+
+// rankOrder 先按相关度降序, 再按原有的排序
+type rankOrder struct {
+	rank    clause.Expression
+	columns []clause.OrderByColumn
+}
+
+func (o rankOrder) Build(builder clause.Builder) {
+	o.rank.Build(builder)
+	builder.WriteString(" DESC")
+	if len(o.columns) > 0 {
+		builder.WriteString(", ")
+		clause.OrderBy{Columns: o.columns}.Build(builder)
+	}
+}
+
+// BuildSearchQuery 在 BuildQuery 的基础上按 text 全文搜索 search fields, postgres 下先按 ts_rank 降序排序, 再按 q.Sort 排序
+// text 为空时与 BuildQuery 相同
+func (b *FilterQueryBuilder) BuildSearchQuery(text string, q *types.PageQuery, db *gorm.DB) (*gorm.DB, error) {
+	if len(strings.TrimSpace(text)) == 0 {
+		return b.BuildQuery(q, db)
+	}
+
+	fields := b.searchFields()
+	if len(fields) == 0 {
+		return nil, errors.New("no search fields, use WithSearchFields or the searchConfig tag")
+	}
+
+	search := Search{Query: text}
+	for _, field := range fields {
+		resolved, err := resolveField(b.schema, field)
+		if err != nil {
+			return nil, err
+		}
+
+		config := fieldSearchConfig(resolved.field, b.searchConfig)
+		if err := checkSearchConfig(config); err != nil {
+			return nil, err
+		}
+		search.Columns = append(search.Columns, SearchColumn{Column: resolved.column, Config: config})
+	}
+
+	db, err := b.applyRelationJoins(db, nil, fields...)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err = b.BuildQuery(q, db.Where(search))
+	if err != nil {
+		return nil, err
+	}
+
+	if db.Dialector == nil || db.Dialector.Name() != "postgres" {
+		return db, nil
+	}
+
+	var columns []clause.OrderByColumn
+	if c, ok := db.Statement.Clauses["ORDER BY"]; ok {
+		if orderBy, ok := c.Expression.(clause.OrderBy); ok {
+			columns = orderBy.Columns
+		}
+	}
+	return db.Clauses(clause.OrderBy{Expression: rankOrder{rank: SearchRank{Search: search}, columns: columns}}), nil
+}
+
+func (b *FilterQueryBuilder) searchFields() []string {
+	if len(b.searchFieldNames) > 0 {
+		return b.searchFieldNames
+	}
+
+	var fields []string
+	for _, field := range b.schema.Fields {
+		if _, ok := field.TagSettings[searchConfigTag]; ok && len(field.DBName) > 0 {
+			fields = append(fields, field.DBName)
+		}
+	}
+	return fields
+}
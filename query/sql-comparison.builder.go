@@ -3,6 +3,8 @@ package query
 import (
 	"fmt"
 	"reflect"
+	"regexp"
+	"strings"
 
 	"gorm.io/gorm/clause"
 )
@@ -30,105 +32,238 @@ func IsBetweenVal(
 	return true
 }
 
+// sliceValues 将 slice / array 转换为 []any, 其他类型返回 nil
+func sliceValues(value any) []any {
+	if value == nil {
+		return nil
+	}
+
+	var values []any
+	if reflect.TypeOf(value).Kind() == reflect.Slice || reflect.TypeOf(value).Kind() == reflect.Array {
+		s := reflect.ValueOf(value)
+
+		values = make([]any, s.Len())
+		for i := 0; i < s.Len(); i++ {
+			values[i] = s.Index(i).Interface()
+		}
+	}
+	return values
+}
+
+// isExpression 根据布尔值 value 生成 IS 或者 IS NOT, negate 为 true 时取反
+func isExpression(operator string, field any, is any, value any, negate bool) (clause.Expression, error) {
+	flag, ok := value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("invalid value for %s expected true or false got %v", operator, value)
+	}
+
+	if negate {
+		flag = !flag
+	}
+
+	if flag {
+		return Is{Column: field, Value: is}, nil
+	}
+	return clause.Not(Is{Column: field, Value: is}), nil
+}
+
+func matchExpression(operator string, field any, value any, mode MatchMode, fold bool) (clause.Expression, error) {
+	str, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid value for %s expected string got %v", operator, value)
+	}
+	return Match{Column: field, Value: str, Mode: mode, Fold: fold}, nil
+}
+
+// regexExpression 使用 go 的 regexp 校验正则, 避免把错误的正则发送到数据库
+func regexExpression(operator string, field any, value any, fold bool) (clause.Expression, error) {
+	pattern, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid value for %s expected string got %v", operator, value)
+	}
+
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %w", operator, err)
+	}
+	return Regex{Column: field, Pattern: pattern, Fold: fold}, nil
+}
+
 type ExpressionFunc func(field string, value any) (clause.Expression, error)
 
-var DEFAULT_COMPARISON_MAP = map[string]ExpressionFunc{
-	"eq": func(field string, value any) (clause.Expression, error) {
+// defaultOperators 内置操作符, 同时支持普通列和 json 路径
+var defaultOperators = map[string]OperatorFunc{
+	"eq": func(operand Operand, value any) (clause.Expression, error) {
 		return clause.Eq{
-			Column: field,
+			Column: operand.Column,
 			Value:  value,
 		}, nil
 	},
-	"neq": func(field string, value any) (clause.Expression, error) {
+	"neq": func(operand Operand, value any) (clause.Expression, error) {
 		return clause.Neq{
-			Column: field,
+			Column: operand.Column,
 			Value:  value,
 		}, nil
 	},
-	"gt": func(field string, value any) (clause.Expression, error) {
+	"gt": func(operand Operand, value any) (clause.Expression, error) {
 		return clause.Gt{
-			Column: field,
+			Column: operand.Column,
 			Value:  value,
 		}, nil
 	},
-	"gte": func(field string, value any) (clause.Expression, error) {
+	"gte": func(operand Operand, value any) (clause.Expression, error) {
 		return clause.Gte{
-			Column: field,
+			Column: operand.Column,
 			Value:  value,
 		}, nil
 	},
-	"lt": func(field string, value any) (clause.Expression, error) {
+	"lt": func(operand Operand, value any) (clause.Expression, error) {
 		return clause.Lt{
-			Column: field,
+			Column: operand.Column,
 			Value:  value,
 		}, nil
 	},
-	"lte": func(field string, value any) (clause.Expression, error) {
+	"lte": func(operand Operand, value any) (clause.Expression, error) {
 		return clause.Lte{
-			Column: field,
+			Column: operand.Column,
 			Value:  value,
 		}, nil
 	},
-	"like": func(field string, value any) (clause.Expression, error) {
+	"like": func(operand Operand, value any) (clause.Expression, error) {
 		return clause.Like{
-			Column: field,
+			Column: operand.Column,
 			Value:  value,
 		}, nil
 	},
-	"notlike": func(field string, value any) (clause.Expression, error) {
+	"notlike": func(operand Operand, value any) (clause.Expression, error) {
 		// NegationBuild
 		return clause.Not(clause.Like{
-			Column: field,
+			Column: operand.Column,
 			Value:  value,
 		}), nil
 	},
-	"ilike": func(field string, value any) (clause.Expression, error) {
-		// NegationBuild
-		return clause.Like{
-			Column: field,
+	"ilike": func(operand Operand, value any) (clause.Expression, error) {
+		return ILike{
+			Column: operand.Column,
 			Value:  value,
 		}, nil
 	},
-	"notilike": func(field string, value any) (clause.Expression, error) {
+	"notilike": func(operand Operand, value any) (clause.Expression, error) {
 		// NegationBuild
-		return clause.Not(clause.Like{
-			Column: field,
+		return clause.Not(ILike{
+			Column: operand.Column,
 			Value:  value,
 		}), nil
 	},
-	"in": func(field string, value any) (clause.Expression, error) {
-		var values []any
-		if reflect.TypeOf(value).Kind() == reflect.Slice || reflect.TypeOf(value).Kind() == reflect.Array {
-			s := reflect.ValueOf(value)
-
-			values = make([]any, s.Len())
-			for i := 0; i < s.Len(); i++ {
-				values[i] = s.Index(i).Interface()
-			}
-		}
-
+	"eqi": func(operand Operand, value any) (clause.Expression, error) {
+		return EqFold{
+			Column: operand.Column,
+			Value:  value,
+		}, nil
+	},
+	"in": func(operand Operand, value any) (clause.Expression, error) {
 		return clause.IN{
-			Column: field,
-			Values: values,
+			Column: operand.Column,
+			Values: sliceValues(value),
 		}, nil
 	},
-	"notin": func(field string, value any) (clause.Expression, error) {
-		var values []any
-		if reflect.TypeOf(value).Kind() == reflect.Slice || reflect.TypeOf(value).Kind() == reflect.Array {
-			s := reflect.ValueOf(value)
-
-			values = make([]any, s.Len())
-			for i := 0; i < s.Len(); i++ {
-				values[i] = s.Index(i).Interface()
-			}
-		}
-
+	"notin": func(operand Operand, value any) (clause.Expression, error) {
 		return clause.Not(clause.IN{
-			Column: field,
-			Values: values,
+			Column: operand.Column,
+			Values: sliceValues(value),
 		}), nil
 	},
-	"between": func(field string, value any) (clause.Expression, error) {
+	"ini": func(operand Operand, value any) (clause.Expression, error) {
+		return InFold{
+			Column: operand.Column,
+			Values: sliceValues(value),
+		}, nil
+	},
+	"contains": func(operand Operand, value any) (clause.Expression, error) {
+		return matchExpression("contains", operand.Column, value, MatchContains, false)
+	},
+	"notcontains": func(operand Operand, value any) (clause.Expression, error) {
+		expression, err := matchExpression("notContains", operand.Column, value, MatchContains, false)
+		if err != nil {
+			return nil, err
+		}
+		return clause.Not(expression), nil
+	},
+	"startswith": func(operand Operand, value any) (clause.Expression, error) {
+		return matchExpression("startsWith", operand.Column, value, MatchStartsWith, false)
+	},
+	"endswith": func(operand Operand, value any) (clause.Expression, error) {
+		return matchExpression("endsWith", operand.Column, value, MatchEndsWith, false)
+	},
+	"containsi": func(operand Operand, value any) (clause.Expression, error) {
+		return matchExpression("containsi", operand.Column, value, MatchContains, true)
+	},
+	"notcontainsi": func(operand Operand, value any) (clause.Expression, error) {
+		expression, err := matchExpression("notContainsi", operand.Column, value, MatchContains, true)
+		if err != nil {
+			return nil, err
+		}
+		return clause.Not(expression), nil
+	},
+	"startswithi": func(operand Operand, value any) (clause.Expression, error) {
+		return matchExpression("startsWithi", operand.Column, value, MatchStartsWith, true)
+	},
+	"endswithi": func(operand Operand, value any) (clause.Expression, error) {
+		return matchExpression("endsWithi", operand.Column, value, MatchEndsWith, true)
+	},
+	"regex": func(operand Operand, value any) (clause.Expression, error) {
+		return regexExpression("regex", operand.Column, value, false)
+	},
+	"iregex": func(operand Operand, value any) (clause.Expression, error) {
+		return regexExpression("iregex", operand.Column, value, true)
+	},
+	"notregex": func(operand Operand, value any) (clause.Expression, error) {
+		expression, err := regexExpression("notRegex", operand.Column, value, false)
+		if err != nil {
+			return nil, err
+		}
+		return clause.Not(expression), nil
+	},
+	// search: 全文搜索, postgres 以外的数据库按词 LIKE 匹配
+	"search": func(operand Operand, value any) (clause.Expression, error) {
+		text, ok := value.(string)
+		if !ok || len(strings.TrimSpace(text)) == 0 {
+			return nil, fmt.Errorf("invalid value for search expected a non-empty string got %v", value)
+		}
+		if err := checkSearchConfig(operand.SearchConfig); err != nil {
+			return nil, err
+		}
+		return Search{Columns: []SearchColumn{{Column: operand.Column, Config: operand.SearchConfig}}, Query: text}, nil
+	},
+	"is": func(operand Operand, value any) (clause.Expression, error) {
+		if value != nil {
+			if _, ok := value.(bool); !ok {
+				return nil, fmt.Errorf("invalid value for is expected null, true or false got %v", value)
+			}
+		}
+		return Is{Column: operand.Column, Value: value}, nil
+	},
+	"isnot": func(operand Operand, value any) (clause.Expression, error) {
+		if value != nil {
+			if _, ok := value.(bool); !ok {
+				return nil, fmt.Errorf("invalid value for isNot expected null, true or false got %v", value)
+			}
+		}
+		return clause.Not(Is{Column: operand.Column, Value: value}), nil
+	},
+	// isNull: true 为 IS NULL, isNull: false 为 IS NOT NULL, 其余同理
+	"isnull": func(operand Operand, value any) (clause.Expression, error) {
+		return isExpression("isNull", operand.Column, nil, value, false)
+	},
+	"isnotnull": func(operand Operand, value any) (clause.Expression, error) {
+		return isExpression("isNotNull", operand.Column, nil, value, true)
+	},
+	"istrue": func(operand Operand, value any) (clause.Expression, error) {
+		return isExpression("isTrue", operand.Column, true, value, false)
+	},
+	"isfalse": func(operand Operand, value any) (clause.Expression, error) {
+		return isExpression("isFalse", operand.Column, false, value, false)
+	},
+	"between": func(operand Operand, value any) (clause.Expression, error) {
 		if !IsBetweenVal(value) {
 			return nil, fmt.Errorf("invalid value for between expected {lower: val, upper: val} got %v", value)
 		}
@@ -137,16 +272,16 @@ var DEFAULT_COMPARISON_MAP = map[string]ExpressionFunc{
 
 		return clause.And(
 			clause.Gte{
-				Column: field,
+				Column: operand.Column,
 				Value:  values["lower"],
 			},
 			clause.Lte{
-				Column: field,
+				Column: operand.Column,
 				Value:  values["upper"],
 			},
 		), nil
 	},
-	"notbetween": func(field string, value any) (clause.Expression, error) {
+	"notbetween": func(operand Operand, value any) (clause.Expression, error) {
 		if !IsBetweenVal(value) {
 			return nil, fmt.Errorf("invalid value for between expected {lower: val, upper: val} got %v", value)
 		}
@@ -155,33 +290,71 @@ var DEFAULT_COMPARISON_MAP = map[string]ExpressionFunc{
 
 		return clause.Not(clause.And(
 			clause.Gte{
-				Column: field,
+				Column: operand.Column,
 				Value:  values["lower"],
 			},
 			clause.Lte{
-				Column: field,
+				Column: operand.Column,
 				Value:  values["upper"],
 			},
 		)), nil
 	},
 }
 
+// DEFAULT_COMPARISON_MAP 只接收列名的默认操作符, 每次创建注册表时读取, 新增或者替换的操作符作用于之后创建的注册表,
+// 只对普通列生效. search 需要字段的 text search configuration, 不在其中
+//
+// Deprecated: 使用 OperatorRegistry.Register
+var DEFAULT_COMPARISON_MAP = expressionFuncs(defaultOperators)
+
+func expressionFuncs(operators map[string]OperatorFunc) map[string]ExpressionFunc {
+	funcs := map[string]ExpressionFunc{}
+	for name, operator := range operators {
+		if name == "search" {
+			continue
+		}
+
+		operator := operator
+		funcs[name] = func(field string, value any) (clause.Expression, error) {
+			return operator(Operand{Column: field}, value)
+		}
+	}
+	return funcs
+}
+
 type SQLComparisonBuilder struct {
+	registry *OperatorRegistry
 }
 
 func NewSQLComparisonBuilder() *SQLComparisonBuilder {
 	return &SQLComparisonBuilder{}
 }
 
-func (b *SQLComparisonBuilder) Build(field string, cmp string, value any, alias string) (clause.Expression, error) {
-	operator, ok := DEFAULT_COMPARISON_MAP[cmp]
-	if !ok {
-		return nil, fmt.Errorf("operator %s not found", cmp)
+// NewSQLComparisonBuilderWithRegistry registry 为 nil 时只使用默认操作符
+func NewSQLComparisonBuilderWithRegistry(registry *OperatorRegistry) *SQLComparisonBuilder {
+	if registry == nil {
+		registry = NewOperatorRegistry()
+	}
+
+	return &SQLComparisonBuilder{
+		registry: registry,
 	}
+}
 
+func (b *SQLComparisonBuilder) Build(field string, cmp string, value any, alias string) (clause.Expression, error) {
 	if len(alias) > 0 {
 		field = fmt.Sprintf("%s.%s", alias, field)
 	}
 
-	return operator(field, value)
+	return b.BuildOperand(Operand{Column: field}, cmp, value)
+}
+
+func (b *SQLComparisonBuilder) BuildOperand(operand Operand, cmp string, value any) (clause.Expression, error) {
+	// 操作符不区分大小写, 如 isNull, notIn
+	operator, ok := b.registry.Lookup(cmp)
+	if !ok {
+		return nil, fmt.Errorf("operator %s not found", cmp)
+	}
+
+	return operator(operand, value)
 }
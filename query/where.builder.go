@@ -1,53 +1,121 @@
 package query
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"gorm.io/gorm/utils"
+)
+
+// 集合关联 (has many, many2many) 的量词, 未指定时为 some
+const (
+	QuantifierSome  = "some"
+	QuantifierEvery = "every"
+	QuantifierNone  = "none"
 )
 
 type WhereBuilder struct {
 	sqlComparisonBuilder *SQLComparisonBuilder
+	// schema 当前层级的 schema, 用于将未 join 的关联编译为 EXISTS 子查询
+	schema *schema.Schema
+	// dialect 数据库方言, 传递给操作符
+	dialect string
+	// searchConfig 默认的 text search configuration
+	searchConfig string
 }
 
 func NewWhereBuilder() *WhereBuilder {
+	return NewWhereBuilderWithRegistry(nil)
+}
+
+// NewWhereBuilderWithRegistry registry 为 nil 时只使用默认操作符
+func NewWhereBuilderWithRegistry(registry *OperatorRegistry) *WhereBuilder {
+	return &WhereBuilder{
+		sqlComparisonBuilder: NewSQLComparisonBuilderWithRegistry(registry),
+	}
+}
+
+func newSchemaWhereBuilder(s *schema.Schema, opts *FilterQueryBuilderOptions) *WhereBuilder {
+	b := NewWhereBuilderWithRegistry(opts.OperatorRegistry)
+	b.schema = s
+	b.searchConfig = opts.SearchConfig
+	return b
+}
+
+func (b *WhereBuilder) relationBuilder(s *schema.Schema) *WhereBuilder {
 	return &WhereBuilder{
-		sqlComparisonBuilder: NewSQLComparisonBuilder(),
+		sqlComparisonBuilder: b.sqlComparisonBuilder,
+		schema:               s,
+		dialect:              b.dialect,
+		searchConfig:         b.searchConfig,
 	}
 }
 
+func (b *WhereBuilder) withDialect(dialect string) *WhereBuilder {
+	return &WhereBuilder{
+		sqlComparisonBuilder: b.sqlComparisonBuilder,
+		schema:               b.schema,
+		dialect:              dialect,
+		searchConfig:         b.searchConfig,
+	}
+}
+
+// build path 为 filter 在整个过滤条件中的位置, 如 filter.or[1], 用于 FilterError
 func (b *WhereBuilder) build(
 	filter map[string]any,
 	relationNames map[string]any,
 	alias string,
+	path string,
 ) (clause.Expression, error) {
 	var expressions []clause.Expression
 
 	if filter["and"] != nil {
-		if and, ok := filter["and"].([]map[string]any); ok {
-			if len(and) > 0 {
-				var err error
-				expression, err := b.filterAnd(and, relationNames, alias)
-				if err != nil {
-					return nil, err
-				}
-				expressions = append(expressions, expression)
+		and, ok := filter["and"].([]map[string]any)
+		if !ok {
+			return nil, &FilterError{Path: path + ".and", Message: fmt.Sprintf("expected an array of filters, got %s", typeName(filter["and"]))}
+		}
+
+		if len(and) > 0 {
+			expression, err := b.filterAnd(and, relationNames, alias, path+".and")
+			if err != nil {
+				return nil, err
 			}
+			expressions = append(expressions, expression)
 		}
 	}
 
 	if filter["or"] != nil {
-		if or, ok := filter["or"].([]map[string]any); ok {
-			if len(or) > 0 {
-				var err error
-				expression, err := b.filterOr(or, relationNames, alias)
-				if err != nil {
-					return nil, err
-				}
-				expressions = append(expressions, expression)
+		or, ok := filter["or"].([]map[string]any)
+		if !ok {
+			return nil, &FilterError{Path: path + ".or", Message: fmt.Sprintf("expected an array of filters, got %s", typeName(filter["or"]))}
+		}
+
+		if len(or) > 0 {
+			expression, err := b.filterOr(or, relationNames, alias, path+".or")
+			if err != nil {
+				return nil, err
 			}
+			expressions = append(expressions, expression)
+		}
+	}
+
+	if filter["not"] != nil {
+		not, ok := filter["not"].(map[string]any)
+		if !ok {
+			return nil, &FilterError{Path: path + ".not", Message: fmt.Sprintf("expected an object, got %s", typeName(filter["not"]))}
+		}
+
+		expression, err := b.filterNot(not, relationNames, alias, path+".not")
+		if err != nil {
+			return nil, err
 		}
+		expressions = append(expressions, expression)
 	}
 
-	expression, err := b.filterFields(filter, relationNames, alias)
+	expression, err := b.filterFields(filter, relationNames, alias, path)
 	if err != nil {
 		return nil, err
 	}
@@ -64,10 +132,10 @@ func (b *WhereBuilder) build(
 
 }
 
-func (b *WhereBuilder) filterAnd(filters []map[string]any, relationNames map[string]any, alias string) (clause.Expression, error) {
+func (b *WhereBuilder) filterAnd(filters []map[string]any, relationNames map[string]any, alias string, path string) (clause.Expression, error) {
 	var expressions []clause.Expression
-	for _, filter := range filters {
-		expression, err := b.build(filter, relationNames, alias)
+	for i, filter := range filters {
+		expression, err := b.build(filter, relationNames, alias, fmt.Sprintf("%s[%d]", path, i))
 		if err != nil {
 			return nil, err
 		}
@@ -77,31 +145,71 @@ func (b *WhereBuilder) filterAnd(filters []map[string]any, relationNames map[str
 	return clause.And(expressions...), nil
 }
 
-func (b *WhereBuilder) filterOr(filters []map[string]any, relationNames map[string]any, alias string) (clause.Expression, error) {
+func (b *WhereBuilder) filterOr(filters []map[string]any, relationNames map[string]any, alias string, path string) (clause.Expression, error) {
 	var expressions []clause.Expression
-	for _, filter := range filters {
-		expression, err := b.build(filter, relationNames, alias)
+	for i, filter := range filters {
+		expression, err := b.build(filter, relationNames, alias, fmt.Sprintf("%s[%d]", path, i))
 		if err != nil {
 			return nil, err
 		}
 		expressions = append(expressions, expression)
 	}
 
+	// 只有一个条件时 gorm 会将 OrConditions 与前一个条件以 OR 连接, 所以直接返回该条件
+	if len(expressions) == 1 {
+		return expressions[0], nil
+	}
+
 	return clause.Or(expressions...), nil
 }
 
-func (b *WhereBuilder) filterFields(filter map[string]any, relationNames map[string]any, alias string) (clause.Expression, error) {
+// filterNot 子条件整体取反, 如 NOT (a AND b)
+// clause.Not 会将 AndConditions 展开后逐个取反, 所以先用括号包装
+// 子条件为空时返回 FilterError, 否则会生成 NOT (NULL) 而不匹配任何记录
+func (b *WhereBuilder) filterNot(filter map[string]any, relationNames map[string]any, alias string, path string) (clause.Expression, error) {
+	expression, err := b.build(filter, relationNames, alias, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if isEmptyExpression(expression) {
+		return nil, &FilterError{Path: path, Message: "expected a non-empty filter"}
+	}
+
+	// 多个条件的 AndConditions, OrConditions 自带括号
+	sql := "(?)"
+	switch e := expression.(type) {
+	case clause.AndConditions:
+		if len(e.Exprs) > 1 {
+			sql = "?"
+		}
+	case clause.OrConditions:
+		if len(e.Exprs) > 1 {
+			sql = "?"
+		}
+	}
+
+	return clause.Not(clause.Expr{SQL: sql, Vars: []any{expression}}), nil
+}
+
+func (b *WhereBuilder) filterFields(filter map[string]any, relationNames map[string]any, alias string, path string) (clause.Expression, error) {
 	var expressions []clause.Expression
 
 	for field, value := range filter {
-		if field != "and" && field != "or" {
+		if !isCombinator(field) {
 			// fmt.Printf("filterFields: %s\n", field)
 			// fmt.Printf("relationNames: %v\n", relationNames)
+			cmp, ok := value.(map[string]any)
+			if !ok {
+				return nil, &FilterError{Path: path + "." + field, Message: fmt.Sprintf("expected an object of operators, got %s", typeName(value))}
+			}
+
 			expression, err := b.withFilterComparison(
 				field,
-				value.(map[string]any),
+				cmp,
 				relationNames,
 				alias,
+				path+"."+field,
 			)
 			if err != nil {
 				return nil, err
@@ -116,16 +224,27 @@ func (b *WhereBuilder) filterFields(filter map[string]any, relationNames map[str
 	return clause.And(expressions...), nil
 }
 
-func (b *WhereBuilder) withFilterComparison(field string, cmp map[string]any, relationNames map[string]any, alias string) (clause.Expression, error) {
-	if relationNames[field] != nil {
-		return b.withRelationFilter(field, cmp, relationNames[field].(map[string]any))
+func (b *WhereBuilder) withFilterComparison(field string, cmp map[string]any, relationNames map[string]any, alias string, path string) (clause.Expression, error) {
+	if relation, ok := lookupRelationName(relationNames, field); ok {
+		return b.withRelationFilter(relation, cmp, relationNames[relation].(map[string]any), alias, path)
+	}
+
+	if b.schema != nil {
+		if relation, ok := lookupRelation(b.schema, field); ok {
+			return b.withExistsFilter(relation, cmp, alias, path)
+		}
+	}
+
+	operand, err := b.operand(field, alias)
+	if err != nil {
+		return nil, &FilterError{Path: path, Message: err.Error(), Err: err}
 	}
 
 	var sqlComparisons []clause.Expression
 	for cmpType, value := range cmp {
-		sqlComparison, err := b.sqlComparisonBuilder.Build(field, cmpType, value, alias)
+		sqlComparison, err := b.sqlComparisonBuilder.BuildOperand(operand.typed(cmpType, value), cmpType, value)
 		if err != nil {
-			return nil, err
+			return nil, wrapFilterError(path+"."+cmpType, err)
 		}
 		sqlComparisons = append(sqlComparisons, sqlComparison)
 	}
@@ -135,12 +254,244 @@ func (b *WhereBuilder) withFilterComparison(field string, cmp map[string]any, re
 	return clause.And(clause.Or(sqlComparisons...)), nil
 }
 
-func (b *WhereBuilder) withRelationFilter(field string, cmp map[string]any, relationNames map[string]any) (clause.Expression, error) {
-	relationWhere := NewWhereBuilder()
-	expr, err := relationWhere.build(cmp, relationNames, field)
+// operand 字段在 schema 中时使用其列名, json 字段的路径如 meta.address.city 默认按文本取值
+// 顶层字段使用表名限定, 避免与 join 的关联表的同名列冲突
+// 字段既不是 schema 中的列也不是 json 路径时返回 UnknownFieldError, 没有 schema 时按原样使用字段名
+func (b *WhereBuilder) operand(field string, alias string) (Operand, error) {
+	column := field
+	operand := Operand{Dialect: b.dialect, SearchConfig: b.searchConfig}
+
+	if b.schema != nil {
+		table := alias
+		if len(table) == 0 {
+			table = b.schema.Table
+		}
+
+		// 支持带表名前缀, 如 users.name
+		name := field
+		if prefix := b.schema.Table + "."; strings.HasPrefix(field, prefix) && b.schema.LookUpField(field) == nil {
+			name = strings.TrimPrefix(field, prefix)
+		}
+
+		if schemaField := b.schema.LookUpField(name); schemaField != nil && len(schemaField.DBName) > 0 {
+			column = schemaField.DBName
+			alias = table
+			operand.Field = schemaField
+			operand.SearchConfig = fieldSearchConfig(schemaField, b.searchConfig)
+		} else if jsonField, path, ok := lookupJSONPath(b.schema, field); ok {
+			operand.Field = jsonField
+			operand.JSONPath = &JSONPath{Column: clause.Column{Table: table, Name: jsonField.DBName}, Path: path}
+			operand.Column = clause.Expr{SQL: "?", Vars: []any{*operand.JSONPath}}
+			return operand, nil
+		}
+
+		if operand.Field == nil {
+			return operand, &UnknownFieldError{Field: field}
+		}
+	}
+
+	if len(alias) > 0 {
+		column = fmt.Sprintf("%s.%s", alias, column)
+	}
+
+	operand.Column = column
+	return operand, nil
+}
+
+func (b *WhereBuilder) withRelationFilter(relation string, cmp map[string]any, relationNames map[string]any, alias string, path string) (clause.Expression, error) {
+	var relationSchema *schema.Schema
+	if b.schema != nil {
+		if r, ok := lookupRelation(b.schema, relation); ok {
+			relationSchema = r.FieldSchema
+		}
+	}
+
+	// 与 gorm 多级 join 的表别名一致, 如 Member__Organization
+	if len(alias) > 0 {
+		relation = utils.NestedRelationName(alias, relation)
+	}
+
+	relationWhere := b.relationBuilder(relationSchema)
+	expr, err := relationWhere.build(cmp, relationNames, relation, path)
 	if err != nil {
 		return nil, err
 	}
 
 	return expr, nil
 }
+
+// withExistsFilter 将未 join 的关联编译为关联子查询, 避免 join has many 关联导致父记录重复
+// some: 存在满足条件的关联记录, none: 不存在满足条件的关联记录, every: 所有关联记录都满足条件
+func (b *WhereBuilder) withExistsFilter(relation *schema.Relationship, cmp map[string]any, alias string, path string) (clause.Expression, error) {
+	quantifiers := map[string]map[string]any{}
+	for key, value := range cmp {
+		if isQuantifier(key) {
+			subFilter, ok := value.(map[string]any)
+			if !ok {
+				return nil, &FilterError{Path: path + "." + key, Message: fmt.Sprintf("expected an object, got %s", typeName(value))}
+			}
+			quantifiers[key] = subFilter
+		}
+	}
+
+	if len(quantifiers) == 0 {
+		quantifiers[QuantifierSome] = cmp
+	} else if len(quantifiers) != len(cmp) {
+		return nil, &FilterError{Path: path, Message: fmt.Sprintf("quantifiers %s, %s, %s can not be mixed with fields of relation %s", QuantifierSome, QuantifierEvery, QuantifierNone, relation.Name)}
+	}
+
+	parentTable := alias
+	if len(parentTable) == 0 {
+		parentTable = clause.CurrentTable
+	}
+
+	relationAlias := relation.Name
+	if len(alias) > 0 {
+		relationAlias = utils.NestedRelationName(alias, relation.Name)
+	}
+
+	// 按量词排序, 保证生成的 sql 稳定
+	keys := make([]string, 0, len(quantifiers))
+	for key := range quantifiers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var expressions []clause.Expression
+	for _, quantifier := range keys {
+		quantifierPath := path
+		if _, ok := cmp[quantifier]; ok {
+			quantifierPath = path + "." + quantifier
+		}
+
+		condition, err := b.relationBuilder(relation.FieldSchema).build(quantifiers[quantifier], nil, relationAlias, quantifierPath)
+		if err != nil {
+			return nil, err
+		}
+
+		switch quantifier {
+		case QuantifierSome:
+			expressions = append(expressions, existsExpression(relation, parentTable, relationAlias, condition))
+		case QuantifierNone:
+			expressions = append(expressions, clause.Not(existsExpression(relation, parentTable, relationAlias, condition)))
+		case QuantifierEvery:
+			if condition == nil {
+				continue
+			}
+			// 条件为 NULL 时同样视为不满足
+			condition = clause.Expr{SQL: "(?) IS NOT TRUE", Vars: []any{condition}}
+			expressions = append(expressions, clause.Not(existsExpression(relation, parentTable, relationAlias, condition)))
+		}
+	}
+
+	return clause.And(expressions...), nil
+}
+
+// isEmptyExpression 不生成任何条件, 如 {}, {"and": []}, {"age": {}}
+func isEmptyExpression(expression clause.Expression) bool {
+	var exprs []clause.Expression
+	switch e := expression.(type) {
+	case nil:
+		return true
+	case clause.AndConditions:
+		exprs = e.Exprs
+	case clause.OrConditions:
+		exprs = e.Exprs
+	default:
+		return false
+	}
+
+	for _, expr := range exprs {
+		if !isEmptyExpression(expr) {
+			return false
+		}
+	}
+	return true
+}
+
+func isCombinator(key string) bool {
+	return key == "and" || key == "or" || key == "not"
+}
+
+// combinatorFilters and, or 的值为过滤条件列表, not 的值为单个过滤条件
+func combinatorFilters(value any) []map[string]any {
+	switch v := value.(type) {
+	case []map[string]any:
+		return v
+	case map[string]any:
+		return []map[string]any{v}
+	}
+	return nil
+}
+
+func isQuantifier(key string) bool {
+	return key == QuantifierSome || key == QuantifierEvery || key == QuantifierNone
+}
+
+// quantifiedFilters 返回量词对应的子过滤条件, 没有量词时返回 nil
+func quantifiedFilters(cmp map[string]any) []map[string]any {
+	var filters []map[string]any
+	for key, value := range cmp {
+		if subFilter, ok := value.(map[string]any); ok && isQuantifier(key) {
+			filters = append(filters, subFilter)
+		}
+	}
+	return filters
+}
+
+// existsExpression EXISTS (SELECT 1 FROM 关联表 WHERE 关联条件 AND condition)
+// many2many 关联通过 INNER JOIN 中间表关联
+func existsExpression(relation *schema.Relationship, parentTable string, relationAlias string, condition clause.Expression) clause.Expression {
+	var (
+		joinAlias      = utils.NestedRelationName(relationAlias, "join")
+		conditions     []clause.Expression
+		joinConditions []clause.Expression
+	)
+
+	for _, ref := range relation.References {
+		column := clause.Column{Table: relationAlias, Name: ref.ForeignKey.DBName}
+		if relation.JoinTable != nil {
+			column.Table = joinAlias
+		}
+
+		switch {
+		case ref.OwnPrimaryKey:
+			conditions = append(conditions, clause.Eq{Column: column, Value: clause.Column{Table: parentTable, Name: ref.PrimaryKey.DBName}})
+		case len(ref.PrimaryValue) > 0:
+			conditions = append(conditions, clause.Eq{Column: column, Value: ref.PrimaryValue})
+		case relation.JoinTable != nil:
+			joinConditions = append(joinConditions, clause.Eq{Column: column, Value: clause.Column{Table: relationAlias, Name: ref.PrimaryKey.DBName}})
+		default:
+			// belongs to
+			conditions = append(conditions, clause.Eq{Column: clause.Column{Table: relationAlias, Name: ref.PrimaryKey.DBName}, Value: clause.Column{Table: parentTable, Name: ref.ForeignKey.DBName}})
+		}
+	}
+
+	if condition != nil {
+		conditions = append(conditions, condition)
+	}
+
+	from := clause.Table{Name: relation.FieldSchema.Table, Alias: relationAlias}
+	if relation.JoinTable != nil {
+		return clause.Expr{
+			SQL:  "EXISTS (SELECT 1 FROM ? INNER JOIN ? ON ? WHERE ?)",
+			Vars: []any{from, clause.Table{Name: relation.JoinTable.Table, Alias: joinAlias}, clause.And(joinConditions...), clause.And(conditions...)},
+		}
+	}
+
+	return clause.Expr{SQL: "EXISTS (SELECT 1 FROM ? WHERE ?)", Vars: []any{from, clause.And(conditions...)}}
+}
+
+// lookupRelationName 在 relationNames 中查找过滤字段对应的关联名, 不区分大小写
+func lookupRelationName(relationNames map[string]any, field string) (string, bool) {
+	if relationNames[field] != nil {
+		return field, true
+	}
+
+	for relation := range relationNames {
+		if strings.EqualFold(relation, field) {
+			return relation, true
+		}
+	}
+	return "", false
+}
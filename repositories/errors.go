@@ -0,0 +1,284 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+type ErrorKind string
+
+const (
+	ErrorKindUniqueViolation      ErrorKind = "unique_violation"
+	ErrorKindForeignKeyViolation  ErrorKind = "foreign_key_violation"
+	ErrorKindNotNullViolation     ErrorKind = "not_null_violation"
+	ErrorKindCheckViolation       ErrorKind = "check_violation"
+	ErrorKindStringTruncation     ErrorKind = "string_truncation"
+	ErrorKindStatementTimeout     ErrorKind = "statement_timeout"
+	ErrorKindLockTimeout          ErrorKind = "lock_timeout"
+	ErrorKindSerializationFailure ErrorKind = "serialization_failure"
+	ErrorKindDeadlock             ErrorKind = "deadlock"
+)
+
+var (
+	ErrAlreadyExists        = errors.New("already exists")
+	ErrForeignKeyViolation  = errors.New("foreign key violation")
+	ErrNotNullViolation     = errors.New("not null violation")
+	ErrCheckViolation       = errors.New("check violation")
+	ErrStringTruncation     = errors.New("string truncation")
+	ErrStatementTimeout     = errors.New("statement timeout")
+	ErrLockTimeout          = errors.New("lock timeout")
+	ErrSerializationFailure = errors.New("serialization failure")
+	ErrDeadlock             = errors.New("deadlock")
+)
+
+var kindErrors = map[ErrorKind][]error{
+	ErrorKindUniqueViolation:      {ErrAlreadyExists, gorm.ErrDuplicatedKey},
+	ErrorKindForeignKeyViolation:  {ErrForeignKeyViolation, gorm.ErrForeignKeyViolated},
+	ErrorKindNotNullViolation:     {ErrNotNullViolation},
+	ErrorKindCheckViolation:       {ErrCheckViolation, gorm.ErrCheckConstraintViolated},
+	ErrorKindStringTruncation:     {ErrStringTruncation},
+	ErrorKindStatementTimeout:     {ErrStatementTimeout},
+	ErrorKindLockTimeout:          {ErrLockTimeout},
+	ErrorKindSerializationFailure: {ErrSerializationFailure},
+	ErrorKindDeadlock:             {ErrDeadlock},
+}
+
+// DBError 归类后的数据库错误, 可以通过 errors.Is(err, ErrAlreadyExists) 判断类型,
+// 或者通过 errors.As 取得表名, 约束名和列名
+type DBError struct {
+	Kind       ErrorKind
+	Table      string
+	Constraint string
+	Column     string
+	Err        error
+}
+
+func (e *DBError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DBError) Is(target error) bool {
+	for _, err := range kindErrors[e.Kind] {
+		if err == target {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyError 将驱动错误归类为 DBError, 无法归类时返回 nil
+// 支持 pgx, go-sql-driver/mysql 以及 mattn/go-sqlite3, modernc.org/sqlite,
+// mysql 和 sqlite 驱动不作为依赖引入, 通过反射读取错误码.
+// context 取消或超时不是数据库错误, 不做归类, 调用方可以直接 errors.Is(err, context.DeadlineExceeded)
+func classifyError(err error) *DBError {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+
+	var dbErr *DBError
+	if errors.As(err, &dbErr) {
+		return dbErr
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return classifyPostgresError(err, pgErr)
+	}
+
+	if number, message, ok := mysqlError(err); ok {
+		return classifyMySQLError(err, number, message)
+	}
+
+	if code, message, ok := sqliteError(err); ok {
+		return classifySQLiteError(err, code, message)
+	}
+
+	switch {
+	// 开启 gorm TranslateError 后, 只能得到 gorm 的错误
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return &DBError{Kind: ErrorKindUniqueViolation, Err: err}
+	case errors.Is(err, gorm.ErrForeignKeyViolated):
+		return &DBError{Kind: ErrorKindForeignKeyViolation, Err: err}
+	case errors.Is(err, gorm.ErrCheckConstraintViolated):
+		return &DBError{Kind: ErrorKindCheckViolation, Err: err}
+	}
+	return nil
+}
+
+var pgKeyDetailRegexp = regexp.MustCompile(`Key \((.+?)\)=`)
+
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+var pgErrorKinds = map[string]ErrorKind{
+	"23505": ErrorKindUniqueViolation,
+	"23503": ErrorKindForeignKeyViolation,
+	"23502": ErrorKindNotNullViolation,
+	"23514": ErrorKindCheckViolation,
+	"22001": ErrorKindStringTruncation,
+	"57014": ErrorKindStatementTimeout,
+	"55P03": ErrorKindLockTimeout,
+	"40001": ErrorKindSerializationFailure,
+	"40P01": ErrorKindDeadlock,
+}
+
+func classifyPostgresError(err error, pgErr *pgconn.PgError) *DBError {
+	kind, ok := pgErrorKinds[pgErr.Code]
+	if !ok {
+		return nil
+	}
+
+	dbErr := &DBError{
+		Kind:       kind,
+		Table:      pgErr.TableName,
+		Constraint: pgErr.ConstraintName,
+		Column:     pgErr.ColumnName,
+		Err:        err,
+	}
+	// 唯一约束和外键约束的列名在 detail 中: Key (email)=(a@b.c) already exists.
+	if len(dbErr.Column) == 0 {
+		if matches := pgKeyDetailRegexp.FindStringSubmatch(pgErr.Detail); matches != nil {
+			dbErr.Column = matches[1]
+		}
+	}
+	return dbErr
+}
+
+func mysqlError(err error) (uint16, string, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		rv := reflect.Indirect(reflect.ValueOf(err))
+		if rv.Kind() != reflect.Struct || rv.Type().PkgPath() != "github.com/go-sql-driver/mysql" {
+			continue
+		}
+		number, message := rv.FieldByName("Number"), rv.FieldByName("Message")
+		if number.Kind() == reflect.Uint16 && message.Kind() == reflect.String {
+			return uint16(number.Uint()), message.String(), true
+		}
+	}
+	return 0, "", false
+}
+
+var (
+	mysqlDuplicateRegexp  = regexp.MustCompile(`for key '(?:([^.']+)\.)?([^']+)'`)
+	mysqlForeignKeyRegexp = regexp.MustCompile("`([^`]+)`, CONSTRAINT `([^`]+)` FOREIGN KEY \\(`([^`]+)`\\)")
+	mysqlColumnRegexp     = regexp.MustCompile(`(?:Column|Field|column) '([^']+)'`)
+	mysqlCheckRegexp      = regexp.MustCompile(`Check constraint '([^']+)'`)
+)
+
+// https://dev.mysql.com/doc/mysql-errors/8.0/en/server-error-reference.html
+var mysqlErrorKinds = map[uint16]ErrorKind{
+	1062: ErrorKindUniqueViolation,
+	1451: ErrorKindForeignKeyViolation,
+	1452: ErrorKindForeignKeyViolation,
+	1048: ErrorKindNotNullViolation,
+	1364: ErrorKindNotNullViolation,
+	3819: ErrorKindCheckViolation,
+	1406: ErrorKindStringTruncation,
+	3024: ErrorKindStatementTimeout,
+	1205: ErrorKindLockTimeout,
+	1213: ErrorKindDeadlock,
+}
+
+func classifyMySQLError(err error, number uint16, message string) *DBError {
+	kind, ok := mysqlErrorKinds[number]
+	if !ok {
+		return nil
+	}
+
+	dbErr := &DBError{Kind: kind, Err: err}
+	switch kind {
+	case ErrorKindUniqueViolation:
+		// Duplicate entry 'a@b.c' for key 'users.idx_users_email'
+		if matches := mysqlDuplicateRegexp.FindStringSubmatch(message); matches != nil {
+			dbErr.Table, dbErr.Constraint = matches[1], matches[2]
+		}
+	case ErrorKindForeignKeyViolation:
+		// Cannot add or update a child row: a foreign key constraint fails (`db`.`members`, CONSTRAINT `fk_members_user` FOREIGN KEY (`user_id`) ...
+		if matches := mysqlForeignKeyRegexp.FindStringSubmatch(message); matches != nil {
+			dbErr.Table, dbErr.Constraint, dbErr.Column = matches[1], matches[2], matches[3]
+		}
+	case ErrorKindCheckViolation:
+		if matches := mysqlCheckRegexp.FindStringSubmatch(message); matches != nil {
+			dbErr.Constraint = matches[1]
+		}
+	case ErrorKindNotNullViolation, ErrorKindStringTruncation:
+		if matches := mysqlColumnRegexp.FindStringSubmatch(message); matches != nil {
+			dbErr.Column = matches[1]
+		}
+	}
+	return dbErr
+}
+
+func sqliteError(err error) (int, string, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		rv := reflect.Indirect(reflect.ValueOf(err))
+		if rv.Kind() != reflect.Struct {
+			continue
+		}
+
+		switch pkgPath := rv.Type().PkgPath(); {
+		case pkgPath == "github.com/mattn/go-sqlite3":
+			if code := rv.FieldByName("ExtendedCode"); code.Kind() == reflect.Int {
+				return int(code.Int()), err.Error(), true
+			}
+		case strings.HasPrefix(pkgPath, "modernc.org/sqlite"), strings.HasPrefix(pkgPath, "github.com/glebarez/go-sqlite"):
+			if coder, ok := err.(interface{ Code() int }); ok {
+				return coder.Code(), err.Error(), true
+			}
+		}
+	}
+	return 0, "", false
+}
+
+var sqliteConstraintRegexp = regexp.MustCompile(`(?:UNIQUE|NOT NULL|CHECK) constraint failed: ([^\s(),]+(?:, [^\s(),]+)*)`)
+
+// https://www.sqlite.org/rescode.html
+var sqliteErrorKinds = map[int]ErrorKind{
+	2067: ErrorKindUniqueViolation,
+	1555: ErrorKindUniqueViolation,
+	787:  ErrorKindForeignKeyViolation,
+	1299: ErrorKindNotNullViolation,
+	275:  ErrorKindCheckViolation,
+	5:    ErrorKindLockTimeout,
+}
+
+func classifySQLiteError(err error, code int, message string) *DBError {
+	kind, ok := sqliteErrorKinds[code]
+	if !ok {
+		// SQLITE_BUSY 的扩展错误码
+		if kind, ok = sqliteErrorKinds[code&0xff]; !ok || kind != ErrorKindLockTimeout {
+			return nil
+		}
+	}
+
+	dbErr := &DBError{Kind: kind, Err: err}
+	matches := sqliteConstraintRegexp.FindStringSubmatch(message)
+	if matches == nil {
+		return dbErr
+	}
+
+	if kind == ErrorKindCheckViolation {
+		dbErr.Constraint = matches[1]
+		return dbErr
+	}
+
+	// UNIQUE constraint failed: users.first_name, users.last_name
+	var columns []string
+	for _, column := range strings.Split(matches[1], ", ") {
+		if table, name, found := strings.Cut(column, "."); found {
+			dbErr.Table = table
+			column = name
+		}
+		columns = append(columns, column)
+	}
+	dbErr.Column = strings.Join(columns, ", ")
+	return dbErr
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
 	"strings"
 	"sync"
 
@@ -19,10 +20,89 @@ import (
 )
 
 type GormCrudRepositoryOptions struct {
+	SingleStatementUpdate bool
+	VersionField          string
+	RetryPolicy           *RetryPolicy
+	FilterQueryOptions    []query.FilterQueryBuilderOption
 }
 
 type GormCrudRepositoryOption func(*GormCrudRepositoryOptions)
 
+// WithSingleStatementUpdate Update 使用单条 UPDATE ... RETURNING 语句, 避免先查询再更新的并发覆盖问题
+func WithSingleStatementUpdate(v bool) GormCrudRepositoryOption {
+	return func(o *GormCrudRepositoryOptions) {
+		o.SingleStatementUpdate = v
+	}
+}
+
+// WithVersionField 指定乐观锁的版本字段, 可以是整数版本号或者 updated_at 这类时间字段
+// 也可以在字段上声明 `gorm:"version"`
+func WithVersionField(field string) GormCrudRepositoryOption {
+	return func(o *GormCrudRepositoryOptions) {
+		o.VersionField = field
+	}
+}
+
+// WithRetryPolicy 对序列化失败和死锁进行重试, 在事务中调用时不重试, 由事务整体重试
+func WithRetryPolicy(policy *RetryPolicy) GormCrudRepositoryOption {
+	return func(o *GormCrudRepositoryOptions) {
+		o.RetryPolicy = policy
+	}
+}
+
+// WithFilterableFields 只允许按这些字段过滤, 关联字段使用路径, 如 user.name
+func WithFilterableFields(fields ...string) GormCrudRepositoryOption {
+	return func(o *GormCrudRepositoryOptions) {
+		o.FilterQueryOptions = append(o.FilterQueryOptions, query.WithFilterableFields(fields...))
+	}
+}
+
+func WithSortableFields(fields ...string) GormCrudRepositoryOption {
+	return func(o *GormCrudRepositoryOptions) {
+		o.FilterQueryOptions = append(o.FilterQueryOptions, query.WithSortableFields(fields...))
+	}
+}
+
+// WithFieldOperators 限制字段可以使用的过滤操作符
+func WithFieldOperators(field string, operators ...string) GormCrudRepositoryOption {
+	return func(o *GormCrudRepositoryOptions) {
+		o.FilterQueryOptions = append(o.FilterQueryOptions, query.WithFieldOperators(field, operators...))
+	}
+}
+
+func WithGroupableFields(fields ...string) GormCrudRepositoryOption {
+	return func(o *GormCrudRepositoryOptions) {
+		o.FilterQueryOptions = append(o.FilterQueryOptions, query.WithGroupableFields(fields...))
+	}
+}
+
+func WithAggregatableFields(fields ...string) GormCrudRepositoryOption {
+	return func(o *GormCrudRepositoryOptions) {
+		o.FilterQueryOptions = append(o.FilterQueryOptions, query.WithAggregatableFields(fields...))
+	}
+}
+
+// WithOperatorRegistry 使用自定义的过滤操作符, 未注册的操作符使用默认实现
+func WithOperatorRegistry(registry *query.OperatorRegistry) GormCrudRepositoryOption {
+	return func(o *GormCrudRepositoryOptions) {
+		o.FilterQueryOptions = append(o.FilterQueryOptions, query.WithOperatorRegistry(registry))
+	}
+}
+
+// WithSearchConfig 全文搜索默认的 text search configuration, 如 english, 字段的 searchConfig 标签优先
+func WithSearchConfig(config string) GormCrudRepositoryOption {
+	return func(o *GormCrudRepositoryOptions) {
+		o.FilterQueryOptions = append(o.FilterQueryOptions, query.WithSearchConfig(config))
+	}
+}
+
+// WithSearchFields Search 搜索的字段, 未指定时使用带有 searchConfig 标签的字段
+func WithSearchFields(fields ...string) GormCrudRepositoryOption {
+	return func(o *GormCrudRepositoryOptions) {
+		o.FilterQueryOptions = append(o.FilterQueryOptions, query.WithSearchFields(fields...))
+	}
+}
+
 type GormCrudRepository[DTO any, CreateDTO any, UpdateDTO any] struct {
 	datasource datasource.DataSource[gorm.DB]
 	Schema     *schema.Schema
@@ -46,7 +126,7 @@ func NewGormCrudRepository[DTO any, CreateDTO any, UpdateDTO any](
 }
 
 func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Create(c context.Context, createDTO *CreateDTO, opts ...types.CreateOption) (*DTO, error) {
-	db, err := r.datasource.GetDB(c)
+	db, err := r.getDB(c)
 	if err != nil {
 		return nil, err
 	}
@@ -56,15 +136,17 @@ func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Create(c context.Context
 	if err != nil {
 		return nil, err
 	}
-	res := db.WithContext(c).Create(&dto)
-	if res.Error != nil {
-		return nil, wrapGormError(res.Error)
+	err = r.retry(c, func() error {
+		return db.WithContext(c).Create(&dto).Error
+	})
+	if err != nil {
+		return nil, wrapGormError(err)
 	}
 	return &dto, nil
 }
 
 func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) CreateMany(c context.Context, items []*CreateDTO, opts ...types.CreateManyOption) ([]*DTO, error) {
-	db, err := r.datasource.GetDB(c)
+	db, err := r.getDB(c)
 	if err != nil {
 		return nil, err
 	}
@@ -84,20 +166,146 @@ func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) CreateMany(c context.Con
 		o(&_opts)
 	}
 
-	createBatchSize := _opts.CreateBatchSize
-	if createBatchSize <= 0 {
-		createBatchSize = 200
+	err = r.retry(c, func() error {
+		return db.Session(&gorm.Session{CreateBatchSize: createBatchSize(_opts.CreateBatchSize)}).WithContext(c).Create(&dtos).Error
+	})
+	if err != nil {
+		return nil, wrapGormError(err)
 	}
+	return dtos, nil
+}
 
-	res := db.Session(&gorm.Session{CreateBatchSize: createBatchSize}).WithContext(c).Create(&dtos)
-	if res.Error != nil {
-		return nil, wrapGormError(res.Error)
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Upsert(c context.Context, createDTO *CreateDTO, opts ...UpsertOption) (*DTO, error) {
+	db, err := r.getDB(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var _opts UpsertOptions
+	for _, o := range opts {
+		o(&_opts)
+	}
+
+	onConflict, err := r.onConflict(&_opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var dto DTO
+	err = mapstructure.Decode(createDTO, &dto)
+	if err != nil {
+		return nil, err
+	}
+	err = r.retry(c, func() error {
+		return db.Clauses(onConflict).WithContext(c).Create(&dto).Error
+	})
+	if err != nil {
+		return nil, wrapGormError(err)
+	}
+
+	if err := r.reloadUpserted(c, db, onConflict, []*DTO{&dto}); err != nil {
+		return nil, err
+	}
+	return &dto, nil
+}
+
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) UpsertMany(c context.Context, items []*CreateDTO, opts ...UpsertOption) ([]*DTO, error) {
+	db, err := r.getDB(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var _opts UpsertOptions
+	for _, o := range opts {
+		o(&_opts)
+	}
+
+	onConflict, err := r.onConflict(&_opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dtos := make([]*DTO, len(items))
+	for i, item := range items {
+		var dto DTO
+		err := mapstructure.Decode(item, &dto)
+		if err != nil {
+			return nil, err
+		}
+		dtos[i] = &dto
+	}
+
+	err = r.retry(c, func() error {
+		return db.Session(&gorm.Session{CreateBatchSize: createBatchSize(_opts.CreateBatchSize)}).Clauses(onConflict).WithContext(c).Create(&dtos).Error
+	})
+	if err != nil {
+		return nil, wrapGormError(err)
+	}
+
+	if err := r.reloadUpserted(c, db, onConflict, dtos); err != nil {
+		return nil, err
 	}
 	return dtos, nil
 }
 
+// reloadUpserted 按冲突列重新读取 upsert 后的记录, 只更新部分列或者冲突时不做任何操作时, 数据库中的记录与输入不同
+// 通过 constraint 指定冲突时按主键读取, 读取不到的记录保持输入
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) reloadUpserted(c context.Context, db *gorm.DB, onConflict clause.OnConflict, dtos []*DTO) error {
+	fields := r.Schema.PrimaryFields
+	if len(onConflict.Columns) > 0 {
+		fields = make([]*schema.Field, len(onConflict.Columns))
+		for i, column := range onConflict.Columns {
+			fields[i] = r.Schema.FieldsByDBName[column.Name]
+		}
+	}
+	if len(fields) == 0 || len(dtos) == 0 {
+		return nil
+	}
+
+	keyValues := func(dto *DTO) []any {
+		rv := reflect.ValueOf(dto).Elem()
+		values := make([]any, len(fields))
+		for i, field := range fields {
+			values[i], _ = field.ValueOf(c, rv)
+		}
+		return values
+	}
+
+	keys := make([]string, len(dtos))
+	var values []any
+	for i, dto := range dtos {
+		keyValue := keyValues(dto)
+		keys[i] = primaryKey(keyValue)
+		if len(keyValue) == 1 {
+			values = append(values, keyValue[0])
+		} else {
+			values = append(values, keyValue)
+		}
+	}
+
+	var result []*DTO
+	err := r.retry(c, func() error {
+		return db.WithContext(c).Where(clause.IN{Column: r.keyColumn(fields), Values: values}).Find(&result).Error
+	})
+	if err != nil {
+		return wrapGormError(err)
+	}
+
+	found := make(map[string]*DTO, len(result))
+	for _, dto := range result {
+		found[primaryKey(keyValues(dto))] = dto
+	}
+
+	for i, dto := range dtos {
+		if stored, ok := found[keys[i]]; ok {
+			*dto = *stored
+		}
+	}
+	return nil
+}
+
 func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Delete(c context.Context, id types.ID, opts ...types.DeleteOption) error {
-	db, err := r.datasource.GetDB(c)
+	db, err := r.getDB(c)
 	if err != nil {
 		return err
 	}
@@ -117,30 +325,196 @@ func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Delete(c context.Context
 		db = db.Unscoped()
 	}
 
-	res := db.Clauses(clause.Returning{}).WithContext(c).Delete(&dto, filter)
-	return wrapGormError(res.Error)
+	versionField, err := r.versionField()
+	if err != nil {
+		return err
+	}
+	expectedVersion, hasExpectedVersion := expectedVersionFromContext(c)
+	if versionField == nil || !hasExpectedVersion {
+		return wrapGormError(r.retry(c, func() error {
+			return db.Clauses(clause.Returning{}).WithContext(c).Delete(&dto, filter).Error
+		}))
+	}
+
+	conditions := map[string]any{versionField.DBName: expectedVersion}
+	for k, v := range filter {
+		conditions[k] = v
+	}
+
+	var rowsAffected int64
+	err = r.retry(c, func() error {
+		res := db.Clauses(clause.Returning{}).WithContext(c).Delete(&dto, conditions)
+		rowsAffected = res.RowsAffected
+		return res.Error
+	})
+	if err != nil {
+		return wrapGormError(err)
+	}
+	if rowsAffected == 0 {
+		err = r.conflictOrNotFound(c, db, filter)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) DeleteMany(c context.Context, filter map[string]any, opts ...types.DeleteOption) (int64, error) {
+	db, err := r.getDB(c)
+	if err != nil {
+		return 0, err
+	}
+
+	var _opts types.DeleteOptions
+	for _, o := range opts {
+		o(&_opts)
+	}
+
+	// 关联过滤的子查询在 mutationQuery 中生成, 需要先 Unscoped 才能包含软删除的记录
+	if _opts.DeleteMode == types.DeleteModeHard {
+		db = db.Unscoped()
+	}
+
+	db, err = r.mutationQuery(c, db, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	var dto DTO
+	var rowsAffected int64
+	err = r.retry(c, func() error {
+		res := db.WithContext(c).Delete(&dto)
+		rowsAffected = res.RowsAffected
+		return res.Error
+	})
+	if err != nil {
+		return 0, wrapGormError(err)
+	}
+	return rowsAffected, nil
 }
 
 func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Update(c context.Context, id types.ID, updateDTO *UpdateDTO, opts ...types.UpdateOption) (*DTO, error) {
-	db, err := r.datasource.GetDB(c)
+	db, err := r.getDB(c)
 	if err != nil {
 		return nil, err
 	}
 
+	versionField, err := r.versionField()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Options.SingleStatementUpdate || versionField != nil {
+		return r.updateReturning(c, db, id, updateDTO, versionField)
+	}
+
 	dto, err := r.Get(c, id)
 	if err != nil {
 		return nil, err
 	}
 	// dto 在 updates之后也被改变了
-	res := db.Model(dto).WithContext(c).Updates(updateDTO)
-	if res.Error != nil {
-		return nil, wrapGormError(res.Error)
+	err = r.retry(c, func() error {
+		return db.Model(dto).WithContext(c).Updates(updateDTO).Error
+	})
+	if err != nil {
+		return nil, wrapGormError(err)
 	}
 	return dto, nil
 }
 
+// updateReturning 以单条 UPDATE ... RETURNING 语句完成更新
+// 不支持 RETURNING 的方言, 在同一个事务中先更新再查询
+// 声明了版本字段时, 追加版本条件并递增版本
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) updateReturning(c context.Context, db *gorm.DB, id types.ID, updateDTO *UpdateDTO, versionField *schema.Field) (*DTO, error) {
+	filter, err := r.primaryKeysFilter(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates any = updateDTO
+	conditions := map[string]any{}
+	for k, v := range filter {
+		conditions[k] = v
+	}
+
+	if versionField != nil {
+		values, expectedVersion, err := r.versionedUpdates(c, versionField, updateDTO)
+		if err != nil {
+			return nil, err
+		}
+		if expectedVersion != nil {
+			conditions[versionField.DBName] = expectedVersion
+		}
+		updates = values
+	}
+
+	var dto DTO
+	if supportsReturning(db) {
+		var rowsAffected int64
+		err = r.retry(c, func() error {
+			res := db.Model(&dto).Clauses(clause.Returning{}).WithContext(c).Where(conditions).Updates(updates)
+			rowsAffected = res.RowsAffected
+			return res.Error
+		})
+		if err != nil {
+			return nil, wrapGormError(err)
+		}
+		if rowsAffected == 0 {
+			if versionField != nil {
+				return nil, wrapGormError(r.conflictOrNotFound(c, db, filter))
+			}
+			return nil, wrapGormError(gorm.ErrRecordNotFound)
+		}
+		return &dto, nil
+	}
+
+	err = r.retry(c, func() error {
+		return db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+			res := tx.Model(&dto).Where(conditions).Updates(updates)
+			if res.Error != nil {
+				return res.Error
+			}
+			// 版本字段总会被修改, RowsAffected 为 0 说明未命中
+			// 未声明版本字段时, mysql 在值未改变时 RowsAffected 也为 0, 因此以查询结果判断记录是否存在
+			if versionField != nil && res.RowsAffected == 0 {
+				return r.conflictOrNotFound(c, tx, filter)
+			}
+			return tx.Where(filter).First(&dto).Error
+		})
+	})
+	if err != nil {
+		return nil, wrapGormError(err)
+	}
+	return &dto, nil
+}
+
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) UpdateMany(c context.Context, filter map[string]any, updateDTO *UpdateDTO) (int64, error) {
+	db, err := r.getDB(c)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err = r.mutationQuery(c, db, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	var dto DTO
+	var rowsAffected int64
+	err = r.retry(c, func() error {
+		res := db.Model(&dto).WithContext(c).Updates(updateDTO)
+		rowsAffected = res.RowsAffected
+		return res.Error
+	})
+	if err != nil {
+		return 0, wrapGormError(err)
+	}
+	return rowsAffected, nil
+}
+
 func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Get(c context.Context, id types.ID, opts ...types.GetOption) (*DTO, error) {
-	db, err := r.datasource.GetDB(c)
+	db, err := r.getDB(c)
 	if err != nil {
 		return nil, err
 	}
@@ -149,41 +523,160 @@ func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Get(c context.Context, i
 	if err != nil {
 		return nil, err
 	}
+
+	filterQueryBuilder := r.newFilterQueryBuilder()
+
+	db, err = filterQueryBuilder.BuildProjection(fieldsFromContext(c), db)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err = filterQueryBuilder.BuildIncludes(includesFromContext(c), db)
+	if err != nil {
+		return nil, err
+	}
+
 	var dto DTO
-	if err := db.WithContext(c).Where(filter).First(&dto).Error; err != nil {
+	err = r.retry(c, func() error {
+		return db.WithContext(c).Where(filter).First(&dto).Error
+	})
+	if err != nil {
 		return nil, wrapGormError(err)
 	}
 	return &dto, nil
 }
 
+// GetMany 通过一次 IN 查询获取多条记录, 结果按照 ids 的顺序返回, 不存在的 id 通过 missing 返回
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) GetMany(c context.Context, ids []types.ID) (dtos []*DTO, missing []types.ID, err error) {
+	if len(ids) == 0 {
+		return []*DTO{}, nil, nil
+	}
+
+	db, err := r.getDB(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]string, len(ids))
+	var values []any
+	seen := make(map[string]bool, len(ids))
+	for i, id := range ids {
+		filter, err := r.primaryKeysFilter(id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		primaryValues := make([]any, len(r.Schema.PrimaryFields))
+		for j, primaryField := range r.Schema.PrimaryFields {
+			primaryValues[j] = filter[primaryField.DBName]
+		}
+		keys[i] = primaryKey(primaryValues)
+
+		if seen[keys[i]] {
+			continue
+		}
+		seen[keys[i]] = true
+
+		if len(primaryValues) == 1 {
+			values = append(values, primaryValues[0])
+		} else {
+			values = append(values, primaryValues)
+		}
+	}
+
+	var result []*DTO
+	err = r.retry(c, func() error {
+		return db.WithContext(c).Where(clause.IN{Column: r.keyColumn(r.Schema.PrimaryFields), Values: values}).Find(&result).Error
+	})
+	if err != nil {
+		return nil, nil, wrapGormError(err)
+	}
+
+	found := make(map[string]*DTO, len(result))
+	for _, dto := range result {
+		rv := reflect.ValueOf(dto).Elem()
+		primaryValues := make([]any, len(r.Schema.PrimaryFields))
+		for i, primaryField := range r.Schema.PrimaryFields {
+			primaryValues[i], _ = primaryField.ValueOf(c, rv)
+		}
+		found[primaryKey(primaryValues)] = dto
+	}
+
+	dtos = make([]*DTO, 0, len(ids))
+	for i, id := range ids {
+		if dto, ok := found[keys[i]]; ok {
+			dtos = append(dtos, dto)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return dtos, missing, nil
+}
+
 func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Query(c context.Context, q *types.PageQuery) ([]*DTO, error) {
-	db, err := r.datasource.GetDB(c)
+	db, err := r.getDB(c)
 	if err != nil {
 		return nil, err
 	}
 
-	filterQueryBuilder := query.NewFilterQueryBuilder(r.Schema)
+	filterQueryBuilder := r.newFilterQueryBuilder()
 
 	db, err = filterQueryBuilder.BuildQuery(q, db)
 	if err != nil {
 		return nil, err
 	}
 
+	db, err = filterQueryBuilder.BuildIncludes(includesFromContext(c), db)
+	if err != nil {
+		return nil, err
+	}
+
 	var dtos []*DTO
-	res := db.WithContext(c).Find(&dtos)
-	if res.Error != nil {
-		return nil, wrapGormError(res.Error)
+	err = r.retry(c, func() error {
+		return db.WithContext(c).Find(&dtos).Error
+	})
+	if err != nil {
+		return nil, wrapGormError(err)
+	}
+	return dtos, nil
+}
+
+// Search 全文搜索, postgres 下按相关度排序, 可以与过滤条件, 排序, 分页组合使用
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Search(c context.Context, text string, q *types.PageQuery) ([]*DTO, error) {
+	db, err := r.getDB(c)
+	if err != nil {
+		return nil, err
+	}
+
+	filterQueryBuilder := r.newFilterQueryBuilder()
+
+	db, err = filterQueryBuilder.BuildSearchQuery(text, q, db)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err = filterQueryBuilder.BuildIncludes(includesFromContext(c), db)
+	if err != nil {
+		return nil, err
+	}
+
+	var dtos []*DTO
+	err = r.retry(c, func() error {
+		return db.WithContext(c).Find(&dtos).Error
+	})
+	if err != nil {
+		return nil, wrapGormError(err)
 	}
 	return dtos, nil
 }
 
 func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Count(c context.Context, q *types.PageQuery) (int64, error) {
-	db, err := r.datasource.GetDB(c)
+	db, err := r.getDB(c)
 	if err != nil {
 		return 0, err
 	}
 
-	filterQueryBuilder := query.NewFilterQueryBuilder(r.Schema)
+	filterQueryBuilder := r.newFilterQueryBuilder()
 
 	db, err = filterQueryBuilder.BuildQuery(q, db)
 	if err != nil {
@@ -192,45 +685,100 @@ func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Count(c context.Context,
 
 	var dto DTO
 	var count int64
-	res := db.WithContext(c).Model(dto).Count(&count)
-	if res.Error != nil {
-		return 0, wrapGormError(res.Error)
+	err = r.retry(c, func() error {
+		return db.WithContext(c).Model(dto).Count(&count).Error
+	})
+	if err != nil {
+		return 0, wrapGormError(err)
 	}
 	return count, nil
 }
 
 func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) QueryOne(c context.Context, filter map[string]any) (*DTO, error) {
-	db, err := r.datasource.GetDB(c)
+	db, err := r.getDB(c)
 	if err != nil {
 		return nil, err
 	}
 
-	filterQueryBuilder := query.NewFilterQueryBuilder(r.Schema)
+	filterQueryBuilder := r.newFilterQueryBuilder()
+
+	db, err = filterQueryBuilder.BuildQuery(&types.PageQuery{Filter: filter, Fields: fieldsFromContext(c)}, db)
+	if err != nil {
+		return nil, err
+	}
 
-	db, err = filterQueryBuilder.BuildQuery(&types.PageQuery{Filter: filter}, db)
+	db, err = filterQueryBuilder.BuildIncludes(includesFromContext(c), db)
 	if err != nil {
 		return nil, err
 	}
 
 	var dto DTO
-	res := db.Model(&dto).WithContext(c).First(&dto)
-	if res.Error != nil {
-		return nil, wrapGormError(res.Error)
+	err = r.retry(c, func() error {
+		return db.Model(&dto).WithContext(c).First(&dto).Error
+	})
+	if err != nil {
+		return nil, wrapGormError(err)
 	}
 	return &dto, nil
 }
 
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Exists(c context.Context, filter map[string]any) (bool, error) {
+	db, err := r.getDB(c)
+	if err != nil {
+		return false, err
+	}
+
+	filterQueryBuilder := r.newFilterQueryBuilder()
+
+	var dto DTO
+	subQuery, err := filterQueryBuilder.BuildQuery(&types.PageQuery{Filter: filter}, db.Model(&dto))
+	if err != nil {
+		return false, err
+	}
+
+	return r.exists(c, db, subQuery)
+}
+
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) ExistsByID(c context.Context, id types.ID) (bool, error) {
+	db, err := r.getDB(c)
+	if err != nil {
+		return false, err
+	}
+
+	filter, err := r.primaryKeysFilter(id)
+	if err != nil {
+		return false, err
+	}
+
+	var dto DTO
+	return r.exists(c, db, db.Model(&dto).Where(filter))
+}
+
+// exists 使用 SELECT EXISTS(SELECT 1 ...), 不读取记录内容
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) exists(c context.Context, db *gorm.DB, subQuery *gorm.DB) (bool, error) {
+	var exists bool
+	err := r.retry(c, func() error {
+		// 直接指定 SELECT 子句, 避免 gorm 追加 join 关联的列
+		subQuery := subQuery.Clauses(clause.Select{Expression: clause.Expr{SQL: "1"}})
+		return db.WithContext(c).Raw("SELECT EXISTS(?)", subQuery).Scan(&exists).Error
+	})
+	if err != nil {
+		return false, wrapGormError(err)
+	}
+	return exists, nil
+}
+
 func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Aggregate(
 	c context.Context,
 	filter map[string]any,
 	aggregateQuery *types.AggregateQuery,
 ) ([]*types.AggregateResponse, error) {
-	db, err := r.datasource.GetDB(c)
+	db, err := r.getDB(c)
 	if err != nil {
 		return nil, err
 	}
 
-	filterQueryBuilder := query.NewFilterQueryBuilder(r.Schema)
+	filterQueryBuilder := r.newFilterQueryBuilder()
 
 	var dto DTO
 	db = db.Model(dto).WithContext(c)
@@ -240,30 +788,39 @@ func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) Aggregate(
 	}
 
 	var results []map[string]any
-	res := db.Find(&results)
-	if res.Error != nil {
-		return nil, wrapGormError(res.Error)
+	err = r.retry(c, func() error {
+		return db.Find(&results).Error
+	})
+	if err != nil {
+		return nil, wrapGormError(err)
 	}
-	return query.ConvertToAggregateResponse(results)
+	return query.AggregateColumnsOf(db).Convert(results)
 }
 
 func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) CursorQuery(c context.Context, q *types.CursorQuery) ([]*DTO, *types.CursorExtra, error) {
-	db, err := r.datasource.GetDB(c)
+	db, err := r.getDB(c)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	filterQueryBuilder := query.NewFilterQueryBuilder(r.Schema)
+	filterQueryBuilder := r.newFilterQueryBuilder()
 
 	db, err = filterQueryBuilder.BuildCursorQuery(q, db)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	db, err = filterQueryBuilder.BuildIncludes(includesFromContext(c), db)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	var result []*DTO
-	res := db.WithContext(c).Find(&result)
-	if res.Error != nil {
-		return nil, nil, wrapGormError(res.Error)
+	err = r.retry(c, func() error {
+		return db.WithContext(c).Find(&result).Error
+	})
+	if err != nil {
+		return nil, nil, wrapGormError(err)
 	}
 
 	extra := &types.CursorExtra{}
@@ -295,8 +852,8 @@ func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) CursorQuery(c context.Co
 			if strings.Contains(baseFieldName, ".") {
 				baseFieldName = strings.Split(baseFieldName, ".")[1]
 			}
-			schemaField, ok := r.Schema.FieldsByDBName[baseFieldName]
-			if !ok {
+			schemaField := r.Schema.LookUpField(baseFieldName)
+			if schemaField == nil {
 				return "", fmt.Errorf("field %s not found", baseFieldName)
 			}
 
@@ -329,6 +886,27 @@ func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) CursorQuery(c context.Co
 	return result, extra, nil
 }
 
+// retry 事务中的语句失败后整个事务都不可用, 因此只在事务外重试
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) retry(c context.Context, fn func() error) error {
+	if _, ok := TransactionFromContext(c); ok {
+		return fn()
+	}
+	return retry(c, r.Options.RetryPolicy, fn)
+}
+
+// newFilterQueryBuilder 使用仓库配置的字段策略, 操作符等选项
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) newFilterQueryBuilder() *query.FilterQueryBuilder {
+	return query.NewFilterQueryBuilder(r.Schema, r.Options.FilterQueryOptions...)
+}
+
+// getDB 优先使用 context 中的事务
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) getDB(c context.Context) (*gorm.DB, error) {
+	if tx, ok := TransactionFromContext(c); ok {
+		return tx, nil
+	}
+	return r.datasource.GetDB(c)
+}
+
 func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) primaryKeysFilter(id types.ID) (map[string]any, error) {
 	filter := make(map[string]any)
 
@@ -357,11 +935,114 @@ func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) primaryKeysFilter(id typ
 	return filter, nil
 }
 
+// mutationQuery 为批量 update / delete 追加过滤条件, 空过滤条件需要通过 WithAllowEmptyFilter 显式允许
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) mutationQuery(c context.Context, db *gorm.DB, filter map[string]any) (*gorm.DB, error) {
+	if len(filter) == 0 {
+		if !allowEmptyFilter(c) {
+			return nil, ErrEmptyFilter
+		}
+		return db.Session(&gorm.Session{AllowGlobalUpdate: true}), nil
+	}
+
+	filterQueryBuilder := r.newFilterQueryBuilder()
+	return filterQueryBuilder.BuildMutationQuery(filter, db)
+}
+
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) onConflict(opts *UpsertOptions) (clause.OnConflict, error) {
+	onConflict := clause.OnConflict{DoNothing: opts.DoNothing}
+
+	if len(opts.ConflictConstraint) > 0 {
+		onConflict.OnConstraint = opts.ConflictConstraint
+	} else if len(opts.ConflictIndex) > 0 {
+		index := r.Schema.LookIndex(opts.ConflictIndex)
+		if index == nil || index.Class != "UNIQUE" {
+			return onConflict, fmt.Errorf("unique index %s not found", opts.ConflictIndex)
+		}
+		for _, indexField := range index.Fields {
+			onConflict.Columns = append(onConflict.Columns, clause.Column{Name: indexField.DBName})
+		}
+	} else {
+		conflictColumns := opts.ConflictColumns
+		if len(conflictColumns) == 0 {
+			conflictColumns = r.Schema.PrimaryFieldDBNames
+		}
+		for _, column := range conflictColumns {
+			if _, ok := r.Schema.FieldsByDBName[column]; !ok {
+				return onConflict, fmt.Errorf("field %s not found", column)
+			}
+			onConflict.Columns = append(onConflict.Columns, clause.Column{Name: column})
+		}
+	}
+
+	if opts.DoNothing {
+		return onConflict, nil
+	}
+
+	if len(opts.UpdateColumns) == 0 {
+		onConflict.UpdateAll = true
+		return onConflict, nil
+	}
+
+	for _, column := range opts.UpdateColumns {
+		if _, ok := r.Schema.FieldsByDBName[column]; !ok {
+			return onConflict, fmt.Errorf("field %s not found", column)
+		}
+	}
+	onConflict.DoUpdates = clause.AssignmentColumns(opts.UpdateColumns)
+
+	return onConflict, nil
+}
+
+// keyColumn IN 查询的列, 多个列时使用 (a, b) IN ((?, ?), (?, ?))
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) keyColumn(fields []*schema.Field) any {
+	if len(fields) == 1 {
+		return clause.Column{Table: r.Schema.Table, Name: fields[0].DBName}
+	}
+
+	columns := make([]any, len(fields))
+	placeholders := make([]string, len(fields))
+	for i, field := range fields {
+		columns[i] = clause.Column{Table: r.Schema.Table, Name: field.DBName}
+		placeholders[i] = "?"
+	}
+	return clause.Expr{SQL: fmt.Sprintf("(%s)", strings.Join(placeholders, ",")), Vars: columns}
+}
+
+// primaryKey 将主键值转换为字符串, 用于匹配 id 和查询结果, 忽略 id 与字段类型的差异 (如 int 和 int64)
+func primaryKey(values []any) string {
+	keys := make([]string, len(values))
+	for i, value := range values {
+		if rv := reflect.Indirect(reflect.ValueOf(value)); rv.IsValid() {
+			keys[i] = fmt.Sprint(rv.Interface())
+		}
+	}
+	return strings.Join(keys, "|")
+}
+
+func supportsReturning(db *gorm.DB) bool {
+	for _, name := range db.Callback().Update().Clauses {
+		if name == "RETURNING" {
+			return true
+		}
+	}
+	return false
+}
+
+func createBatchSize(size int) int {
+	if size <= 0 {
+		return 200
+	}
+	return size
+}
+
 func wrapGormError(err error) error {
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return types.ErrNotFound
 		}
+		if dbErr := classifyError(err); dbErr != nil {
+			return dbErr
+		}
 	}
 	return err
 }
@@ -2,21 +2,29 @@ package repositories_test
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/duolacloud/crud-core-gorm/query"
 	"github.com/duolacloud/crud-core-gorm/repositories"
 	"github.com/duolacloud/crud-core/datasource"
 	"github.com/duolacloud/crud-core/types"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
 )
 
 type IdentityEntity struct {
@@ -74,6 +82,74 @@ func (user *OrganizationEntity) TableName() string {
 	return "organizations"
 }
 
+type ArticleEntity struct {
+	ID        string `gorm:"column:id;type:string; size:40; primaryKey"`
+	Title     string `gorm:"column:title"`
+	Version   int    `gorm:"column:version;version"`
+	UpdatedAt time.Time
+}
+
+func (article *ArticleEntity) TableName() string {
+	return "articles"
+}
+
+type ProjectEntity struct {
+	ID      string                    `gorm:"column:id;type:string; size:40; primaryKey"`
+	Name    string                    `gorm:"column:name"`
+	OwnerID string                    `gorm:"column:owner_id"`
+	Owner   *OrganizationMemberEntity `json:"owner" gorm:"foreignKey:OwnerID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	// 列名中含有 __, 与关联字段 owner.name 的别名相同
+	OwnerName string `gorm:"column:owner__name"`
+}
+
+func (project *ProjectEntity) TableName() string {
+	return "projects"
+}
+
+type GroupEntity struct {
+	ID    string        `gorm:"column:id;type:string; size:40; primaryKey"`
+	Name  string        `gorm:"column:name"`
+	Users []*UserEntity `json:"users" gorm:"many2many:group_users;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+func (group *GroupEntity) TableName() string {
+	return "groups"
+}
+
+type DeviceEntity struct {
+	ID   string           `gorm:"column:id;type:string; size:40; primaryKey"`
+	Name string           `gorm:"column:name"`
+	Meta json.RawMessage  `gorm:"column:meta;type:jsonb"`
+	Tags query.ArrayValue `gorm:"column:tags;type:text[]"`
+}
+
+func (device *DeviceEntity) TableName() string {
+	return "devices"
+}
+
+type NoteEntity struct {
+	ID     string `gorm:"column:id;type:string; size:40; primaryKey"`
+	Author string `gorm:"column:author"`
+	Title  string `gorm:"column:title;searchConfig:english"`
+	Body   string `gorm:"column:body;searchConfig:english"`
+}
+
+func (note *NoteEntity) TableName() string {
+	return "notes"
+}
+
+type TaskEntity struct {
+	ID        string         `gorm:"column:id;type:string; size:40; primaryKey"`
+	Title     string         `gorm:"column:title"`
+	UserID    string         `gorm:"column:user_id"`
+	User      *UserEntity    `json:"user" gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	DeletedAt gorm.DeletedAt `gorm:"column:deleted_at"`
+}
+
+func (task *TaskEntity) TableName() string {
+	return "tasks"
+}
+
 func SetupDB() datasource.DataSource[gorm.DB] {
 	newLogger := logger.New(
 		log.New(os.Stdout, "\r\n", log.LstdFlags), // io writer
@@ -93,7 +169,7 @@ func SetupDB() datasource.DataSource[gorm.DB] {
 		panic(dberr)
 	}
 
-	dberr = db.AutoMigrate(&UserEntity{}, &IdentityEntity{}, &UserRelationEntity{}, &OrganizationEntity{}, &OrganizationMemberEntity{})
+	dberr = db.AutoMigrate(&UserEntity{}, &IdentityEntity{}, &UserRelationEntity{}, &OrganizationEntity{}, &OrganizationMemberEntity{}, &ArticleEntity{}, &ProjectEntity{}, &GroupEntity{}, &DeviceEntity{}, &NoteEntity{}, &TaskEntity{})
 	if dberr != nil {
 		panic(dberr)
 	}
@@ -251,7 +327,7 @@ func TestGormCrudRepository(t *testing.T) {
 	query := &types.PageQuery{
 		Fields: []string{
 			"name",
-			"_id",
+			"id",
 		},
 		Filter: map[string]any{
 			"age": map[string]any{
@@ -552,3 +628,1590 @@ func TestGet(t *testing.T) {
 	gotRelation, err = relationRepo.Get(c, map[string]any{"from": from, "to": "douyin|12345"})
 	assert.ErrorIs(t, err, types.ErrNotFound)
 }
+
+func TestUpsert(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	userID := uuid.NewString()
+	u, err := r.Upsert(c, &UserEntity{
+		ID:       userID,
+		Name:     "张三",
+		Country:  "china",
+		Birthday: time.Now(),
+	})
+	assert.NoError(t, err)
+	defer r.Delete(c, userID)
+
+	u.Name = "李四"
+	u.Country = "japan"
+	upsertedUser, err := r.Upsert(c, u, repositories.WithUpdateColumns("name"))
+	assert.NoError(t, err)
+
+	// 返回数据库中的记录, 而不是输入
+	gotUser, err := r.Get(c, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, "李四", gotUser.Name)
+	assert.Equal(t, "china", gotUser.Country)
+	assert.Equal(t, "李四", upsertedUser.Name)
+	assert.Equal(t, "china", upsertedUser.Country)
+
+	u.Name = "王五"
+	upsertedUser, err = r.Upsert(c, u, repositories.WithDoNothing(true))
+	assert.NoError(t, err)
+	assert.Equal(t, "李四", upsertedUser.Name)
+
+	gotUser, err = r.Get(c, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, "李四", gotUser.Name)
+
+	var users []*UserEntity
+	for i := 0; i < 5; i++ {
+		users = append(users, &UserEntity{
+			ID:       fmt.Sprintf("%s-%d", userID, i),
+			Name:     fmt.Sprintf("用户%v", i),
+			Birthday: time.Now(),
+		})
+	}
+	users = append(users, gotUser)
+	gotUser.Age = 30
+	gotUser.Country = "japan"
+
+	upsertedUsers, err := r.UpsertMany(c, users, repositories.WithUpsertBatchSize(2), repositories.WithUpdateColumns("age"))
+	assert.NoError(t, err)
+	assert.Len(t, upsertedUsers, 6)
+	if len(upsertedUsers) == 6 {
+		assert.Equal(t, users[0].ID, upsertedUsers[0].ID)
+		assert.Equal(t, 30, upsertedUsers[5].Age)
+		assert.Equal(t, "china", upsertedUsers[5].Country)
+	}
+	defer func() {
+		for _, u := range upsertedUsers {
+			_ = r.Delete(c, u.ID)
+		}
+	}()
+
+	gotUser, err = r.Get(c, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, 30, gotUser.Age)
+
+	_, err = r.Upsert(c, u, repositories.WithConflictIndex("idx_not_exists"))
+	assert.Error(t, err)
+}
+
+func TestUpdateManyAndDeleteMany(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	country := uuid.NewString()
+	var users []*UserEntity
+	for i := 0; i < 5; i++ {
+		users = append(users, &UserEntity{
+			ID:       uuid.NewString(),
+			Name:     fmt.Sprintf("用户%v", i),
+			Country:  country,
+			Age:      18 + i,
+			Birthday: time.Now(),
+		})
+	}
+	createdUsers, err := r.CreateMany(c, users)
+	assert.NoError(t, err)
+	defer func() {
+		for _, u := range createdUsers {
+			_ = r.Delete(c, u.ID)
+		}
+	}()
+
+	_, err = r.UpdateMany(c, nil, &map[string]any{"age": 0})
+	assert.ErrorIs(t, err, repositories.ErrEmptyFilter)
+
+	_, err = r.DeleteMany(c, map[string]any{})
+	assert.ErrorIs(t, err, repositories.ErrEmptyFilter)
+
+	updated, err := r.UpdateMany(c, map[string]any{
+		"country": map[string]any{"eq": country},
+		"age":     map[string]any{"gte": 20},
+	}, &map[string]any{"name": "成年用户"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), updated)
+
+	deleted, err := r.DeleteMany(c, map[string]any{
+		"country": map[string]any{"eq": country},
+		"name":    map[string]any{"eq": "成年用户"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), deleted)
+
+	count, err := r.Count(c, &types.PageQuery{
+		Filter: map[string]any{"country": map[string]any{"eq": country}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestHardDeleteManyWithRelationFilter(t *testing.T) {
+	db := SetupDB()
+
+	userRepo := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+	r := repositories.NewGormCrudRepository[TaskEntity, TaskEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	userID := uuid.NewString()
+	userName := uuid.NewString()
+	_, err := userRepo.Create(c, &UserEntity{ID: userID, Name: userName, Birthday: time.Now()})
+	assert.NoError(t, err)
+	defer userRepo.Delete(c, userID)
+
+	tasks := []*TaskEntity{
+		{ID: uuid.NewString(), Title: "任务1", UserID: userID},
+		{ID: uuid.NewString(), Title: "任务2", UserID: userID},
+	}
+	_, err = r.CreateMany(c, tasks)
+	assert.NoError(t, err)
+
+	err = r.Delete(c, tasks[0].ID, types.WithDeleteMode(types.DeleteModeSoft))
+	assert.NoError(t, err)
+
+	// 关联过滤的子查询也要包含软删除的记录
+	filter := map[string]any{"user": map[string]any{"name": map[string]any{"eq": userName}}}
+	deleted, err := r.DeleteMany(c, filter)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+
+	gdb, err := db.GetDB(c)
+	assert.NoError(t, err)
+	var remaining int64
+	assert.NoError(t, gdb.Unscoped().Model(&TaskEntity{}).Where("user_id = ?", userID).Count(&remaining).Error)
+	assert.Equal(t, int64(0), remaining)
+}
+
+func TestSingleStatementUpdate(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db, repositories.WithSingleStatementUpdate(true))
+
+	c := context.TODO()
+
+	userID := uuid.NewString()
+	_, err := r.Create(c, &UserEntity{
+		ID:       userID,
+		Name:     "张三",
+		Country:  "china",
+		Birthday: time.Now(),
+	})
+	assert.NoError(t, err)
+	defer r.Delete(c, userID)
+
+	u, err := r.Update(c, userID, &map[string]any{
+		"name": "李四",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, userID, u.ID)
+	assert.Equal(t, "李四", u.Name)
+	assert.Equal(t, "china", u.Country)
+
+	_, err = r.Update(c, uuid.NewString(), &map[string]any{
+		"name": "李四",
+	})
+	assert.ErrorIs(t, err, types.ErrNotFound)
+}
+
+func TestOptimisticLock(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[ArticleEntity, ArticleEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	articleID := uuid.NewString()
+	article, err := r.Create(c, &ArticleEntity{
+		ID:      articleID,
+		Title:   "标题",
+		Version: 1,
+	})
+	assert.NoError(t, err)
+	defer r.Delete(c, articleID)
+
+	article, err = r.Update(c, articleID, &map[string]any{
+		"title":   "标题1",
+		"version": article.Version,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, article.Version)
+
+	// 使用过期的版本号
+	_, err = r.Update(c, articleID, &map[string]any{
+		"title":   "标题2",
+		"version": 1,
+	})
+	assert.ErrorIs(t, err, repositories.ErrVersionConflict)
+
+	_, err = r.Update(repositories.WithExpectedVersion(c, 2), uuid.NewString(), &map[string]any{
+		"title": "标题2",
+	})
+	assert.ErrorIs(t, err, types.ErrNotFound)
+
+	err = r.Delete(repositories.WithExpectedVersion(c, 1), articleID)
+	assert.ErrorIs(t, err, repositories.ErrVersionConflict)
+
+	err = r.Delete(repositories.WithExpectedVersion(c, 2), articleID)
+	assert.NoError(t, err)
+
+	_, err = r.Get(c, articleID)
+	assert.ErrorIs(t, err, types.ErrNotFound)
+}
+
+func TestRunInTransaction(t *testing.T) {
+	db := SetupDB()
+
+	userRepo := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+	orgRepo := repositories.NewGormCrudRepository[OrganizationEntity, OrganizationEntity, OrganizationEntity](db)
+
+	c := context.TODO()
+
+	userID := uuid.NewString()
+	orgID := uuid.NewString()
+	rollbackErr := errors.New("rollback")
+
+	err := repositories.RunInTransaction(c, db, func(c context.Context) error {
+		_, err := userRepo.Create(c, &UserEntity{ID: userID, Name: "张三", Birthday: time.Now()})
+		assert.NoError(t, err)
+
+		_, err = orgRepo.Create(c, &OrganizationEntity{ID: orgID, Name: "组织"})
+		assert.NoError(t, err)
+
+		return rollbackErr
+	}, repositories.WithIsolationLevel(sql.LevelSerializable))
+	assert.ErrorIs(t, err, rollbackErr)
+
+	_, err = userRepo.Get(c, userID)
+	assert.ErrorIs(t, err, types.ErrNotFound)
+	_, err = orgRepo.Get(c, orgID)
+	assert.ErrorIs(t, err, types.ErrNotFound)
+
+	// 内层事务回滚到 savepoint, 不影响外层事务
+	err = repositories.RunInTransaction(c, db, func(c context.Context) error {
+		_, err := userRepo.Create(c, &UserEntity{ID: userID, Name: "张三", Birthday: time.Now()})
+		assert.NoError(t, err)
+
+		err = repositories.RunInTransaction(c, db, func(c context.Context) error {
+			_, err := orgRepo.Create(c, &OrganizationEntity{ID: orgID, Name: "组织"})
+			assert.NoError(t, err)
+			return rollbackErr
+		})
+		assert.ErrorIs(t, err, rollbackErr)
+
+		return nil
+	})
+	assert.NoError(t, err)
+	defer userRepo.Delete(c, userID)
+
+	_, err = userRepo.Get(c, userID)
+	assert.NoError(t, err)
+	_, err = orgRepo.Get(c, orgID)
+	assert.ErrorIs(t, err, types.ErrNotFound)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[ArticleEntity, ArticleEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	assert.True(t, repositories.IsRetryable(&pgconn.PgError{Code: "40001"}))
+	assert.True(t, repositories.IsRetryable(fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: "40P01"})))
+	assert.False(t, repositories.IsRetryable(&pgconn.PgError{Code: "23505"}))
+
+	articleID := uuid.NewString()
+	_, err := r.Create(c, &ArticleEntity{ID: articleID, Title: "标题"})
+	assert.NoError(t, err)
+	defer r.Delete(c, articleID)
+
+	// 两个 serializable 事务读取同一行后并发更新, 后提交的事务会得到 40001, 重试后成功
+	var read sync.WaitGroup
+	read.Add(2)
+
+	var done sync.WaitGroup
+	stats := make([]*repositories.RetryStats, 2)
+	for i := 0; i < 2; i++ {
+		i := i
+		stats[i] = &repositories.RetryStats{}
+		done.Add(1)
+
+		go func() {
+			defer done.Done()
+
+			var once sync.Once
+			err := repositories.RunInTransaction(repositories.WithRetryStats(c, stats[i]), db, func(c context.Context) error {
+				if _, err := r.Get(c, articleID); err != nil {
+					return err
+				}
+				once.Do(func() {
+					read.Done()
+					read.Wait()
+				})
+				_, err := r.Update(c, articleID, &map[string]any{"title": fmt.Sprintf("标题%d", i)})
+				return err
+			}, repositories.WithIsolationLevel(sql.LevelSerializable), repositories.WithTransactionRetryPolicy(repositories.DefaultRetryPolicy()))
+			assert.NoError(t, err)
+		}()
+	}
+	done.Wait()
+
+	assert.Equal(t, 1, stats[0].Retries+stats[1].Retries)
+}
+
+func TestErrorClassification(t *testing.T) {
+	db := SetupDB()
+
+	userRepo := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+	memberRepo := repositories.NewGormCrudRepository[OrganizationMemberEntity, OrganizationMemberEntity, OrganizationMemberEntity](db)
+
+	c := context.TODO()
+
+	userID := uuid.NewString()
+	_, err := userRepo.Create(c, &UserEntity{ID: userID, Name: "张三", Birthday: time.Now()})
+	assert.NoError(t, err)
+	defer userRepo.Delete(c, userID)
+
+	_, err = userRepo.Create(c, &UserEntity{ID: userID, Name: "张三", Birthday: time.Now()})
+	assert.ErrorIs(t, err, repositories.ErrAlreadyExists)
+
+	var dbErr *repositories.DBError
+	assert.True(t, errors.As(err, &dbErr))
+	assert.Equal(t, repositories.ErrorKindUniqueViolation, dbErr.Kind)
+	assert.Equal(t, "users", dbErr.Table)
+	assert.Equal(t, "id", dbErr.Column)
+
+	_, err = memberRepo.Create(c, &OrganizationMemberEntity{
+		ID:             uuid.NewString(),
+		Name:           "成员",
+		UserID:         uuid.NewString(),
+		OrganizationID: uuid.NewString(),
+	})
+	assert.ErrorIs(t, err, repositories.ErrForeignKeyViolation)
+	assert.True(t, errors.As(err, &dbErr))
+	assert.Equal(t, "organization_members", dbErr.Table)
+	assert.NotEmpty(t, dbErr.Constraint)
+
+	_, err = userRepo.Create(c, &UserEntity{ID: strings.Repeat("x", 41), Name: "张三", Birthday: time.Now()})
+	assert.ErrorIs(t, err, repositories.ErrStringTruncation)
+
+	// 等待行锁超时是锁超时, 不是语句超时
+	gdb, err := db.GetDB(c)
+	assert.NoError(t, err)
+	locker := gdb.Begin()
+	assert.NoError(t, locker.Exec("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Error)
+	err = repositories.RunInTransaction(c, db, func(c context.Context) error {
+		tx, _ := repositories.TransactionFromContext(c)
+		if err := tx.Exec("SET LOCAL lock_timeout = '100ms'").Error; err != nil {
+			return err
+		}
+		_, err := userRepo.Update(c, userID, &map[string]any{"name": "李四"})
+		return err
+	})
+	locker.Rollback()
+	assert.ErrorIs(t, err, repositories.ErrLockTimeout)
+	assert.NotErrorIs(t, err, repositories.ErrStatementTimeout)
+	assert.True(t, errors.As(err, &dbErr))
+	assert.Equal(t, repositories.ErrorKindLockTimeout, dbErr.Kind)
+
+	// context 超时原样返回, 不归类为语句超时
+	timeoutCtx, cancel := context.WithTimeout(c, time.Millisecond)
+	defer cancel()
+	<-timeoutCtx.Done()
+	_, err = userRepo.Get(timeoutCtx, userID)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, repositories.ErrStatementTimeout)
+	assert.False(t, errors.As(err, &dbErr))
+}
+
+func TestGetMany(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	var users []*UserEntity
+	for i := 0; i < 3; i++ {
+		users = append(users, &UserEntity{
+			ID:       uuid.NewString(),
+			Name:     fmt.Sprintf("用户%v", i),
+			Birthday: time.Now(),
+		})
+	}
+	createdUsers, err := r.CreateMany(c, users)
+	assert.NoError(t, err)
+	defer func() {
+		for _, u := range createdUsers {
+			_ = r.Delete(c, u.ID)
+		}
+	}()
+
+	missingID := uuid.NewString()
+	gotUsers, missing, err := r.GetMany(c, []types.ID{users[2].ID, missingID, users[0].ID})
+	assert.NoError(t, err)
+	assert.Len(t, gotUsers, 2)
+	assert.Equal(t, users[2].ID, gotUsers[0].ID)
+	assert.Equal(t, users[0].ID, gotUsers[1].ID)
+	assert.Equal(t, []types.ID{missingID}, missing)
+
+	relationRepo := repositories.NewGormCrudRepository[UserRelationEntity, UserRelationEntity, map[string]any](db)
+
+	relation := &UserRelationEntity{
+		From:   uuid.NewString(),
+		To:     uuid.NewString(),
+		Status: true,
+	}
+	_, err = relationRepo.Create(c, relation)
+	assert.NoError(t, err)
+	defer relationRepo.Delete(c, map[string]any{"from": relation.From, "to": relation.To})
+
+	gotRelations, missing, err := relationRepo.GetMany(c, []types.ID{
+		map[string]any{"from": relation.From, "to": uuid.NewString()},
+		map[string]any{"from": relation.From, "to": relation.To},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, gotRelations, 1)
+	assert.Equal(t, relation.To, gotRelations[0].To)
+	assert.Len(t, missing, 1)
+}
+
+func TestExists(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	userID := uuid.NewString()
+	_, err := r.Create(c, &UserEntity{ID: userID, Name: userID, Birthday: time.Now()})
+	assert.NoError(t, err)
+	defer r.Delete(c, userID)
+
+	exists, err := r.ExistsByID(c, userID)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = r.ExistsByID(c, uuid.NewString())
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = r.Exists(c, map[string]any{"name": map[string]any{"eq": userID}})
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = r.Exists(c, map[string]any{"name": map[string]any{"eq": uuid.NewString()}})
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestProjection(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	country := uuid.NewString()
+	var users []*UserEntity
+	for i := 0; i < 3; i++ {
+		users = append(users, &UserEntity{
+			ID:       uuid.NewString(),
+			Name:     fmt.Sprintf("用户%v", i),
+			Country:  country,
+			Age:      18 + i,
+			Birthday: time.Now().Add(time.Duration(i) * time.Hour),
+		})
+	}
+	createdUsers, err := r.CreateMany(c, users)
+	assert.NoError(t, err)
+	defer func() {
+		for _, u := range createdUsers {
+			_ = r.Delete(c, u.ID)
+		}
+	}()
+
+	filter := map[string]any{"country": map[string]any{"eq": country}}
+
+	us, err := r.Query(c, &types.PageQuery{
+		Fields: []string{"id", "name"},
+		Filter: filter,
+		Sort:   []string{"age"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, us, 3)
+	assert.Equal(t, users[0].ID, us[0].ID)
+	assert.Equal(t, users[0].Name, us[0].Name)
+	assert.Empty(t, us[0].Country)
+	assert.Zero(t, us[0].Age)
+
+	_, err = r.Query(c, &types.PageQuery{
+		Fields: []string{"password_hash"},
+		Filter: filter,
+	})
+	assert.Error(t, err)
+
+	us, extra, err := r.CursorQuery(c, &types.CursorQuery{
+		Fields: []string{"name"},
+		Filter: filter,
+		Limit:  2,
+		Sort:   []string{"-birthday"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, us, 2)
+	assert.Equal(t, users[2].ID, us[0].ID)
+	assert.Empty(t, us[0].Country)
+
+	us, _, err = r.CursorQuery(c, &types.CursorQuery{
+		Fields: []string{"name"},
+		Filter: filter,
+		Cursor: extra.EndCursor,
+		Limit:  2,
+		Sort:   []string{"-birthday"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, us, 1)
+	assert.Equal(t, users[0].ID, us[0].ID)
+
+	// 投影与排序接受相同的字段名, 列名或者结构体字段名
+	us, err = r.Query(c, &types.PageQuery{
+		Fields: []string{"users.id", "Name"},
+		Filter: filter,
+		Sort:   []string{"-Age"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, us, 3)
+	assert.Equal(t, users[2].ID, us[0].ID)
+	assert.Equal(t, users[2].Name, us[0].Name)
+	assert.Zero(t, us[0].Age)
+
+	us, extra, err = r.CursorQuery(c, &types.CursorQuery{
+		Fields: []string{"name"},
+		Filter: filter,
+		Limit:  2,
+		Sort:   []string{"Age"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, us, 2)
+	assert.Equal(t, users[0].ID, us[0].ID)
+
+	us, _, err = r.CursorQuery(c, &types.CursorQuery{
+		Fields: []string{"name"},
+		Filter: filter,
+		Cursor: extra.EndCursor,
+		Limit:  2,
+		Sort:   []string{"Age"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, us, 1)
+	assert.Equal(t, users[2].ID, us[0].ID)
+
+	u, err := r.Get(repositories.WithFields(c, "name"), users[1].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, users[1].Name, u.Name)
+	assert.Empty(t, u.ID)
+	assert.Empty(t, u.Country)
+}
+
+func TestIncludes(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+	m := repositories.NewGormCrudRepository[OrganizationMemberEntity, OrganizationMemberEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	userID := uuid.NewString()
+	_, err := r.Create(c, &UserEntity{
+		ID:       userID,
+		Name:     "用户",
+		Birthday: time.Now(),
+		Identities: []*IdentityEntity{
+			{ID: uuid.NewString(), Provider: "github"},
+			{ID: uuid.NewString(), Provider: "google"},
+			{ID: uuid.NewString(), Provider: "wechat"},
+		},
+	})
+	assert.NoError(t, err)
+	defer r.Delete(c, userID)
+
+	u, err := r.Get(c, userID)
+	assert.NoError(t, err)
+	assert.Empty(t, u.Identities)
+
+	u, err = r.Get(repositories.WithIncludes(c, query.Include{Relation: "identities"}), userID)
+	assert.NoError(t, err)
+	assert.Len(t, u.Identities, 3)
+
+	// 过滤, 排序, 每个用户只取第 1 条
+	us, err := r.Query(repositories.WithIncludes(c, query.Include{
+		Relation: "identities",
+		Filter:   map[string]any{"provider": map[string]any{"neq": "google"}},
+		Sort:     []string{"-provider"},
+		Limit:    1,
+	}), &types.PageQuery{
+		Fields: []string{"name"},
+		Filter: map[string]any{"id": map[string]any{"eq": userID}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, us, 1)
+	assert.Len(t, us[0].Identities, 1)
+	assert.Equal(t, "wechat", us[0].Identities[0].Provider)
+
+	_, err = r.Get(repositories.WithIncludes(c, query.Include{Relation: "friends"}), userID)
+	assert.Error(t, err)
+
+	organizationID := uuid.NewString()
+	memberID := uuid.NewString()
+	o := repositories.NewGormCrudRepository[OrganizationEntity, OrganizationEntity, map[string]any](db)
+	_, err = o.Create(c, &OrganizationEntity{ID: organizationID, Name: "组织"})
+	assert.NoError(t, err)
+	defer o.Delete(c, organizationID)
+
+	_, err = m.Create(c, &OrganizationMemberEntity{
+		ID:             memberID,
+		Name:           "成员",
+		UserID:         userID,
+		OrganizationID: organizationID,
+	})
+	assert.NoError(t, err)
+	defer m.Delete(c, memberID)
+
+	member, err := m.QueryOne(repositories.WithIncludes(c,
+		query.Include{Relation: "user.identities", Sort: []string{"provider"}},
+		query.Include{Relation: "organization"},
+	), map[string]any{"id": map[string]any{"eq": memberID}})
+	assert.NoError(t, err)
+	assert.Equal(t, organizationID, member.Organization.ID)
+	assert.Equal(t, userID, member.User.ID)
+	assert.Len(t, member.User.Identities, 3)
+	assert.Equal(t, "github", member.User.Identities[0].Provider)
+
+	// many2many 关联不支持 Limit, 预加载的记录会分配给 join table 中关联的所有父记录
+	g := repositories.NewGormCrudRepository[GroupEntity, GroupEntity, map[string]any](db)
+	groupID := uuid.NewString()
+	_, err = g.Create(c, &GroupEntity{ID: groupID, Name: "分组", Users: []*UserEntity{{ID: userID}}})
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, g.Delete(c, groupID))
+	}()
+
+	group, err := g.Get(repositories.WithIncludes(c, query.Include{Relation: "users"}), groupID)
+	assert.NoError(t, err)
+	assert.Len(t, group.Users, 1)
+
+	_, err = g.Get(repositories.WithIncludes(c, query.Include{Relation: "users", Limit: 1}), groupID)
+	assert.ErrorContains(t, err, "many2many")
+
+	// 空的或者未知的排序字段返回错误
+	_, err = m.QueryOne(repositories.WithIncludes(c, query.Include{Relation: "user.identities", Sort: []string{""}}), map[string]any{"id": map[string]any{"eq": memberID}})
+	assert.ErrorContains(t, err, "empty sort field")
+
+	_, err = m.QueryOne(repositories.WithIncludes(c, query.Include{Relation: "user.identities", Sort: []string{"-"}, Limit: 1}), map[string]any{"id": map[string]any{"eq": memberID}})
+	assert.ErrorContains(t, err, "empty sort field")
+
+	_, err = m.QueryOne(repositories.WithIncludes(c, query.Include{Relation: "user.identities", Sort: []string{"nosuch"}}), map[string]any{"id": map[string]any{"eq": memberID}})
+	assert.ErrorIs(t, err, query.ErrUnknownField)
+}
+
+func TestMultiLevelRelationFilter(t *testing.T) {
+	db := SetupDB()
+
+	u := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+	o := repositories.NewGormCrudRepository[OrganizationEntity, OrganizationEntity, map[string]any](db)
+	m := repositories.NewGormCrudRepository[OrganizationMemberEntity, OrganizationMemberEntity, map[string]any](db)
+	p := repositories.NewGormCrudRepository[ProjectEntity, ProjectEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	organizationName := uuid.NewString()
+	userName := uuid.NewString()
+
+	organization, err := o.Create(c, &OrganizationEntity{ID: uuid.NewString(), Name: organizationName})
+	assert.NoError(t, err)
+	defer o.Delete(c, organization.ID)
+
+	user, err := u.Create(c, &UserEntity{ID: uuid.NewString(), Name: userName, Birthday: time.Now()})
+	assert.NoError(t, err)
+	defer u.Delete(c, user.ID)
+
+	member, err := m.Create(c, &OrganizationMemberEntity{ID: uuid.NewString(), Name: "成员", UserID: user.ID, OrganizationID: organization.ID})
+	assert.NoError(t, err)
+	defer m.Delete(c, member.ID)
+
+	project, err := p.Create(c, &ProjectEntity{ID: uuid.NewString(), Name: "项目", OwnerID: member.ID})
+	assert.NoError(t, err)
+	defer p.Delete(c, project.ID)
+
+	// 多级关联
+	ps, err := p.Query(c, &types.PageQuery{
+		Filter: map[string]any{
+			"owner": map[string]any{
+				"organization": map[string]any{"name": map[string]any{"eq": organizationName}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, ps, 1)
+	assert.Equal(t, project.ID, ps[0].ID)
+
+	// 同级的多个关联
+	count, err := p.Count(c, &types.PageQuery{
+		Filter: map[string]any{
+			"owner": map[string]any{
+				"organization": map[string]any{"name": map[string]any{"eq": organizationName}},
+				"user":         map[string]any{"name": map[string]any{"eq": userName}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	count, err = p.Count(c, &types.PageQuery{
+		Filter: map[string]any{
+			"owner": map[string]any{
+				"organization": map[string]any{"name": map[string]any{"eq": organizationName}},
+				"user":         map[string]any{"name": map[string]any{"eq": uuid.NewString()}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+
+	count, err = p.UpdateMany(c, map[string]any{
+		"owner": map[string]any{
+			"user": map[string]any{"name": map[string]any{"eq": userName}},
+		},
+	}, &map[string]any{"name": "新项目"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestCollectionRelationFilter(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	country := uuid.NewString()
+	newUser := func(providers ...string) *UserEntity {
+		userID := uuid.NewString()
+		var identities []*IdentityEntity
+		for _, provider := range providers {
+			identities = append(identities, &IdentityEntity{ID: uuid.NewString(), UserID: userID, Provider: provider})
+		}
+		return &UserEntity{ID: userID, Name: userID, Country: country, Birthday: time.Now(), Identities: identities}
+	}
+
+	users := []*UserEntity{
+		newUser("google", "github"),
+		newUser("google", "google"),
+		newUser("wechat"),
+		newUser(),
+	}
+	createdUsers, err := r.CreateMany(c, users)
+	assert.NoError(t, err)
+	defer func() {
+		for _, u := range createdUsers {
+			_ = r.Delete(c, u.ID)
+		}
+	}()
+
+	count := func(identities map[string]any) int64 {
+		count, err := r.Count(c, &types.PageQuery{
+			Filter: map[string]any{
+				"country":    map[string]any{"eq": country},
+				"identities": identities,
+			},
+		})
+		assert.NoError(t, err)
+		return count
+	}
+
+	google := map[string]any{"provider": map[string]any{"eq": "google"}}
+
+	// 多条关联记录满足条件时, 父记录不重复
+	assert.Equal(t, int64(2), count(google))
+	assert.Equal(t, int64(2), count(map[string]any{"some": google}))
+	// 没有关联记录时 every 成立
+	assert.Equal(t, int64(2), count(map[string]any{"every": google}))
+	assert.Equal(t, int64(2), count(map[string]any{"none": google}))
+	assert.Equal(t, int64(1), count(map[string]any{"none": map[string]any{}}))
+
+	us, _, err := r.CursorQuery(c, &types.CursorQuery{
+		Filter: map[string]any{
+			"country":    map[string]any{"eq": country},
+			"identities": google,
+		},
+		Limit: 1,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, us, 1)
+
+	_, err = r.Count(c, &types.PageQuery{
+		Filter: map[string]any{
+			"identities": map[string]any{"some": google, "provider": map[string]any{"eq": "google"}},
+		},
+	})
+	assert.Error(t, err)
+}
+
+func TestFieldValidation(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+	p := repositories.NewGormCrudRepository[ProjectEntity, ProjectEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	country := uuid.NewString()
+	var users []*UserEntity
+	for i := 0; i < 3; i++ {
+		users = append(users, &UserEntity{
+			ID:       uuid.NewString(),
+			Name:     fmt.Sprintf("用户%v", i),
+			Country:  country,
+			Age:      18 + i,
+			Birthday: time.Now(),
+		})
+	}
+	createdUsers, err := r.CreateMany(c, users)
+	assert.NoError(t, err)
+	defer func() {
+		for _, u := range createdUsers {
+			_ = r.Delete(c, u.ID)
+		}
+	}()
+
+	filter := map[string]any{"country": map[string]any{"eq": country}}
+
+	us, err := r.Query(c, &types.PageQuery{Filter: filter, Sort: []string{"-Age"}})
+	assert.NoError(t, err)
+	assert.Len(t, us, 3)
+	assert.Equal(t, 20, us[0].Age)
+
+	_, err = r.Query(c, &types.PageQuery{Filter: filter, Sort: []string{"age; DROP TABLE users"}})
+	assert.ErrorIs(t, err, query.ErrUnknownField)
+
+	_, err = r.Aggregate(c, filter, &types.AggregateQuery{GroupBy: []string{"country) FROM users; --"}})
+	assert.ErrorIs(t, err, query.ErrUnknownField)
+
+	_, err = r.Aggregate(c, filter, &types.AggregateQuery{Count: []string{"password_hash"}})
+	var unknownFieldErr *query.UnknownFieldError
+	assert.ErrorAs(t, err, &unknownFieldErr)
+	assert.Equal(t, "password_hash", unknownFieldErr.Field)
+
+	// 过滤条件中的未知字段在生成 sql 之前返回错误, 包含出错的位置
+	_, err = r.Query(c, &types.PageQuery{Filter: map[string]any{
+		"country": map[string]any{"eq": country},
+		"or":      []map[string]any{{"nosuch": map[string]any{"eq": 1}}},
+	}})
+	assert.ErrorIs(t, err, query.ErrUnknownField)
+	var filterErr *query.FilterError
+	if assert.ErrorAs(t, err, &filterErr) {
+		assert.Equal(t, "filter.or[0].nosuch", filterErr.Path)
+	}
+
+	_, err = r.Count(c, &types.PageQuery{Filter: map[string]any{"identities": map[string]any{"nosuch": map[string]any{"eq": 1}}}})
+	assert.ErrorIs(t, err, query.ErrUnknownField)
+
+	count, err := r.Count(c, &types.PageQuery{Filter: map[string]any{"users.country": map[string]any{"eq": country}}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+
+	aggs, err := r.Aggregate(c, filter, &types.AggregateQuery{
+		GroupBy: []string{"country"},
+		Count:   []string{"id"},
+		Max:     []string{"age"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, aggs, 1)
+	assert.Equal(t, country, aggs[0].GroupBy["country"])
+	assert.EqualValues(t, 3, aggs[0].Count["id"])
+	assert.EqualValues(t, 20, aggs[0].Max["age"])
+
+	// 按关联字段排序和分组时自动 join
+	_, err = p.Query(c, &types.PageQuery{Sort: []string{"owner.organization.name"}})
+	assert.NoError(t, err)
+
+	_, err = p.Aggregate(c, nil, &types.AggregateQuery{GroupBy: []string{"owner.user.country"}, Count: []string{"id"}})
+	assert.NoError(t, err)
+
+	// 顶层字段与 join 的关联表存在同名列 name
+	projectFilter := map[string]any{"name": map[string]any{"eq": uuid.NewString()}}
+	ps, err := p.Query(c, &types.PageQuery{Filter: projectFilter, Sort: []string{"owner.name"}})
+	assert.NoError(t, err)
+	assert.Empty(t, ps)
+
+	projectAggs, err := p.Aggregate(c, projectFilter, &types.AggregateQuery{GroupBy: []string{"owner.name"}, Count: []string{"id"}})
+	assert.NoError(t, err)
+	assert.Empty(t, projectAggs)
+}
+
+func TestAggregateRelationAlias(t *testing.T) {
+	db := SetupDB()
+
+	u := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+	o := repositories.NewGormCrudRepository[OrganizationEntity, OrganizationEntity, map[string]any](db)
+	m := repositories.NewGormCrudRepository[OrganizationMemberEntity, OrganizationMemberEntity, map[string]any](db)
+	p := repositories.NewGormCrudRepository[ProjectEntity, ProjectEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	organization, err := o.Create(c, &OrganizationEntity{ID: uuid.NewString(), Name: "acme"})
+	assert.NoError(t, err)
+	defer o.Delete(c, organization.ID)
+
+	user, err := u.Create(c, &UserEntity{ID: uuid.NewString(), Name: uuid.NewString(), Birthday: time.Now()})
+	assert.NoError(t, err)
+	defer u.Delete(c, user.ID)
+
+	member, err := m.Create(c, &OrganizationMemberEntity{ID: uuid.NewString(), Name: "成员", UserID: user.ID, OrganizationID: organization.ID})
+	assert.NoError(t, err)
+	defer m.Delete(c, member.ID)
+
+	project, err := p.Create(c, &ProjectEntity{ID: uuid.NewString(), Name: uuid.NewString(), OwnerID: member.ID, OwnerName: "旧成员"})
+	assert.NoError(t, err)
+	defer p.Delete(c, project.ID)
+
+	// owner.name 与 owner__name 的别名相同, 结果按构建查询时的别名映射还原
+	aggs, err := p.Aggregate(c, map[string]any{"id": map[string]any{"eq": project.ID}}, &types.AggregateQuery{
+		GroupBy: []string{"owner.name", "owner__name"},
+		Count:   []string{"id"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, aggs, 1)
+	if len(aggs) == 1 {
+		assert.Equal(t, "成员", aggs[0].GroupBy["owner.name"])
+		assert.Equal(t, "旧成员", aggs[0].GroupBy["owner__name"])
+		assert.EqualValues(t, 1, aggs[0].Count["id"])
+	}
+}
+
+func TestFieldPolicy(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db,
+		repositories.WithFilterableFields("name", "country", "identities.provider"),
+		repositories.WithFieldOperators("name", "eq", "in"),
+		repositories.WithSortableFields("age"),
+		repositories.WithGroupableFields("country"),
+		repositories.WithAggregatableFields("age"),
+	)
+
+	c := context.TODO()
+
+	_, err := r.Query(c, &types.PageQuery{
+		Filter: map[string]any{
+			"name":       map[string]any{"in": []string{"张三", "李四"}},
+			"identities": map[string]any{"provider": map[string]any{"eq": "google"}},
+		},
+		Sort: []string{"-age"},
+	})
+	assert.NoError(t, err)
+
+	var policyErr *query.FieldPolicyError
+
+	_, err = r.Query(c, &types.PageQuery{
+		Filter: map[string]any{"age": map[string]any{"gt": 18}},
+	})
+	assert.ErrorIs(t, err, query.ErrFieldNotAllowed)
+	assert.ErrorAs(t, err, &policyErr)
+	assert.Equal(t, "age", policyErr.Field)
+
+	_, err = r.Count(c, &types.PageQuery{
+		Filter: map[string]any{"name": map[string]any{"like": "%张%"}},
+	})
+	assert.ErrorAs(t, err, &policyErr)
+	assert.Equal(t, "name", policyErr.Field)
+	assert.Equal(t, "like", policyErr.Operator)
+
+	_, _, err = r.CursorQuery(c, &types.CursorQuery{Sort: []string{"name"}, Limit: 10})
+	assert.ErrorAs(t, err, &policyErr)
+	assert.Equal(t, query.FieldUsageSort, policyErr.Usage)
+
+	_, err = r.Aggregate(c, nil, &types.AggregateQuery{GroupBy: []string{"country"}, Max: []string{"age"}})
+	assert.NoError(t, err)
+
+	_, err = r.Aggregate(c, nil, &types.AggregateQuery{GroupBy: []string{"name"}, Max: []string{"age"}})
+	assert.ErrorIs(t, err, query.ErrFieldNotAllowed)
+
+	_, err = r.Aggregate(c, nil, &types.AggregateQuery{GroupBy: []string{"country"}, Max: []string{"birthday"}})
+	assert.ErrorIs(t, err, query.ErrFieldNotAllowed)
+}
+
+// createFixtures 创建 scope 内的测试记录, 测试结束时按 scope 删除, 删除失败时测试失败
+// 返回在 scope 内按 filter 计数的函数
+func createFixtures[DTO any](t *testing.T, r *repositories.GormCrudRepository[DTO, DTO, map[string]any], scope map[string]any, items ...*DTO) func(filter map[string]any) int64 {
+	t.Helper()
+
+	c := context.TODO()
+
+	_, err := r.CreateMany(c, items)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_, err := r.DeleteMany(c, scope)
+		assert.NoError(t, err)
+	})
+
+	return func(filter map[string]any) int64 {
+		t.Helper()
+
+		scoped := map[string]any{}
+		for key, value := range scope {
+			scoped[key] = value
+		}
+		for key, value := range filter {
+			scoped[key] = value
+		}
+
+		count, err := r.Count(c, &types.PageQuery{Filter: scoped})
+		assert.NoError(t, err)
+		return count
+	}
+}
+
+func TestCaseInsensitiveOperators(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+
+	country := uuid.NewString()
+	var users []*UserEntity
+	for _, name := range []string{"Alice", "alice", "Bob"} {
+		users = append(users, &UserEntity{ID: uuid.NewString(), Name: name, Country: country, Birthday: time.Now()})
+	}
+	countNames := createFixtures(t, r, map[string]any{"country": map[string]any{"eq": country}}, users...)
+	count := func(name map[string]any) int64 {
+		return countNames(map[string]any{"name": name})
+	}
+
+	assert.Equal(t, int64(1), count(map[string]any{"like": "A%"}))
+	assert.Equal(t, int64(2), count(map[string]any{"ilike": "A%"}))
+	assert.Equal(t, int64(1), count(map[string]any{"notilike": "A%"}))
+	assert.Equal(t, int64(2), count(map[string]any{"eqi": "ALICE"}))
+	assert.Equal(t, int64(3), count(map[string]any{"ini": []string{"ALICE", "bob"}}))
+
+	// 空列表与 in, notin 一致
+	assert.Equal(t, int64(0), count(map[string]any{"ini": []string{}}))
+	assert.Equal(t, int64(0), count(map[string]any{"in": []string{}}))
+	assert.Equal(t, int64(3), count(map[string]any{"notin": []string{}}))
+
+	registry := query.NewOperatorRegistry()
+	registry.Register("notini", func(operand query.Operand, value any) (clause.Expression, error) {
+		return clause.Not(query.InFold{Column: operand.Column, Values: []any{}}), nil
+	})
+	rr := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db, repositories.WithOperatorRegistry(registry))
+	negated, err := rr.Count(context.TODO(), &types.PageQuery{
+		Filter: map[string]any{
+			"country": map[string]any{"eq": country},
+			"name":    map[string]any{"notini": []string{}},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), negated)
+}
+
+func TestNullAndBooleanOperators(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserRelationEntity, UserRelationEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	from := uuid.NewString()
+	count := createFixtures(t, r, map[string]any{"from": map[string]any{"eq": from}},
+		&UserRelationEntity{From: from, To: uuid.NewString(), Status: true},
+		&UserRelationEntity{From: from, To: uuid.NewString(), Status: false},
+		&UserRelationEntity{From: from, To: uuid.NewString(), Status: false},
+	)
+
+	assert.Equal(t, int64(1), count(map[string]any{"status": map[string]any{"isTrue": true}}))
+	assert.Equal(t, int64(2), count(map[string]any{"status": map[string]any{"isFalse": true}}))
+	assert.Equal(t, int64(2), count(map[string]any{"status": map[string]any{"isNot": true}}))
+	assert.Equal(t, int64(1), count(map[string]any{"status": map[string]any{"is": true}}))
+	assert.Equal(t, int64(3), count(map[string]any{"created_at": map[string]any{"isNotNull": true}}))
+	assert.Equal(t, int64(0), count(map[string]any{"created_at": map[string]any{"isNull": true}}))
+	assert.Equal(t, int64(0), count(map[string]any{"created_at": map[string]any{"is": nil}}))
+
+	_, err := r.Count(c, &types.PageQuery{Filter: map[string]any{"status": map[string]any{"is": "yes"}}})
+	assert.Error(t, err)
+
+	_, err = r.Count(c, &types.PageQuery{Filter: map[string]any{"status": map[string]any{"isNull": "yes"}}})
+	assert.Error(t, err)
+}
+
+func TestStringMatchOperators(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	country := uuid.NewString()
+	var users []*UserEntity
+	for _, name := range []string{"100% Pure", "100 Pure", "Pure_Water", "PureXWater"} {
+		users = append(users, &UserEntity{ID: uuid.NewString(), Name: name, Country: country, Birthday: time.Now()})
+	}
+	countNames := createFixtures(t, r, map[string]any{"country": map[string]any{"eq": country}}, users...)
+	count := func(name map[string]any) int64 {
+		return countNames(map[string]any{"name": name})
+	}
+
+	// % 和 _ 不作为通配符
+	assert.Equal(t, int64(1), count(map[string]any{"contains": "0% "}))
+	assert.Equal(t, int64(1), count(map[string]any{"contains": "_"}))
+	assert.Equal(t, int64(3), count(map[string]any{"notContains": "_"}))
+	assert.Equal(t, int64(2), count(map[string]any{"startsWith": "100"}))
+	assert.Equal(t, int64(2), count(map[string]any{"endsWith": "Water"}))
+	assert.Equal(t, int64(4), count(map[string]any{"containsi": "PURE"}))
+	assert.Equal(t, int64(2), count(map[string]any{"startsWithi": "pure"}))
+	assert.Equal(t, int64(2), count(map[string]any{"endsWithi": "WATER"}))
+	assert.Equal(t, int64(2), count(map[string]any{"notContainsi": "WATER"}))
+
+	_, err := r.Count(c, &types.PageQuery{Filter: map[string]any{"name": map[string]any{"contains": 1}}})
+	assert.Error(t, err)
+}
+
+func TestOperatorRegistry(t *testing.T) {
+	db := SetupDB()
+
+	registry := query.NewOperatorRegistry()
+	// 按字段类型生成条件: 字符串字段大小写不敏感, 其他字段直接比较
+	registry.Register("same", func(operand query.Operand, value any) (clause.Expression, error) {
+		if operand.Field != nil && operand.Field.DataType == schema.String {
+			return query.EqFold{Column: operand.Column, Value: value}, nil
+		}
+		return clause.Eq{Column: operand.Column, Value: value}, nil
+	})
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db, repositories.WithOperatorRegistry(registry))
+
+	c := context.TODO()
+
+	country := uuid.NewString()
+	count := createFixtures(t, r, map[string]any{"country": map[string]any{"eq": country}},
+		&UserEntity{ID: uuid.NewString(), Name: "Jack", Country: country, Age: 20, Birthday: time.Now()},
+	)
+
+	assert.Equal(t, int64(1), count(map[string]any{
+		"name": map[string]any{"same": "JACK"},
+		"age":  map[string]any{"same": 20},
+	}))
+
+	// 未注册自定义操作符的 repository 不受影响
+	_, err := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db).Count(c, &types.PageQuery{
+		Filter: map[string]any{"name": map[string]any{"same": "JACK"}},
+	})
+	assert.Error(t, err)
+
+	// 覆盖默认操作符只影响当前注册表
+	registry.Register("contains", func(operand query.Operand, value any) (clause.Expression, error) {
+		return query.EqFold{Column: operand.Column, Value: value}, nil
+	})
+	assert.Equal(t, int64(1), count(map[string]any{"name": map[string]any{"contains": "JACK"}}))
+
+	defaultCount, err := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db).Count(c, &types.PageQuery{
+		Filter: map[string]any{
+			"country": map[string]any{"eq": country},
+			"name":    map[string]any{"contains": "JACK"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), defaultCount)
+
+	// DEFAULT_COMPARISON_MAP 中替换或者新增的操作符作用于之后的查询
+	eq := query.DEFAULT_COMPARISON_MAP["eq"]
+	t.Cleanup(func() {
+		query.DEFAULT_COMPARISON_MAP["eq"] = eq
+		delete(query.DEFAULT_COMPARISON_MAP, "legacyNe")
+	})
+	query.DEFAULT_COMPARISON_MAP["eq"] = func(field string, value any) (clause.Expression, error) {
+		return query.EqFold{Column: field, Value: value}, nil
+	}
+	query.DEFAULT_COMPARISON_MAP["legacyNe"] = func(field string, value any) (clause.Expression, error) {
+		return clause.Neq{Column: field, Value: value}, nil
+	}
+
+	d := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+	defaultCount, err = d.Count(c, &types.PageQuery{
+		Filter: map[string]any{
+			"country": map[string]any{"legacyNe": "x"},
+			"name":    map[string]any{"eq": "JACK"},
+			"and":     []map[string]any{{"country": map[string]any{"eq": country}}},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), defaultCount)
+}
+
+func TestJSONOperators(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[DeviceEntity, DeviceEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	name := uuid.NewString()
+	count := createFixtures(t, r, map[string]any{"name": map[string]any{"eq": name}},
+		&DeviceEntity{ID: uuid.NewString(), Name: name, Meta: json.RawMessage(`{"address": {"city": "Paris", "zip": "75001"}, "tags": ["a", "b"], "active": true}`)},
+		&DeviceEntity{ID: uuid.NewString(), Name: name, Meta: json.RawMessage(`{"address": {"city": "Berlin"}, "tags": ["b"], "score": 3}`)},
+		&DeviceEntity{ID: uuid.NewString(), Name: name, Meta: json.RawMessage(`{"score": 12}`)},
+	)
+
+	assert.Equal(t, int64(1), count(map[string]any{"meta.address.city": map[string]any{"eq": "Paris"}}))
+	assert.Equal(t, int64(1), count(map[string]any{"meta.address.city": map[string]any{"startsWith": "Ber"}}))
+	assert.Equal(t, int64(2), count(map[string]any{"meta.tags.0": map[string]any{"in": []string{"a", "b"}}}))
+	assert.Equal(t, int64(1), count(map[string]any{"meta": map[string]any{"jsonContains": map[string]any{"tags": []string{"a"}}}}))
+	assert.Equal(t, int64(1), count(map[string]any{"meta.address": map[string]any{"jsonContains": map[string]any{"city": "Berlin"}}}))
+	assert.Equal(t, int64(2), count(map[string]any{"meta": map[string]any{"hasKey": "score"}}))
+	assert.Equal(t, int64(2), count(map[string]any{"meta.address": map[string]any{"hasAnyKeys": []string{"zip", "city"}}}))
+	assert.Equal(t, int64(1), count(map[string]any{"meta.address": map[string]any{"hasAllKeys": []string{"zip", "city"}}}))
+	assert.Equal(t, int64(2), count(map[string]any{"meta": map[string]any{"jsonPath": "$.score ? (@ > 2)"}}))
+
+	// 数字, 布尔值按值的类型比较, 按文本比较时 "12" < "2"
+	assert.Equal(t, int64(2), count(map[string]any{"meta.score": map[string]any{"gt": 2}}))
+	assert.Equal(t, int64(1), count(map[string]any{"meta.score": map[string]any{"between": map[string]any{"lower": 2, "upper": 10}}}))
+	assert.Equal(t, int64(1), count(map[string]any{"meta.score": map[string]any{"notBetween": map[string]any{"lower": 2, "upper": 10}}}))
+	assert.Equal(t, int64(2), count(map[string]any{"meta.score": map[string]any{"in": []int{3, 12}}}))
+	assert.Equal(t, int64(1), count(map[string]any{"meta.score": map[string]any{"eq": "3"}}))
+	assert.Equal(t, int64(1), count(map[string]any{"meta.active": map[string]any{"eq": true}}))
+
+	// json 操作符只能用于 json 字段
+	_, err := r.Count(c, &types.PageQuery{Filter: map[string]any{"name": map[string]any{"hasKey": "a"}}})
+	assert.Error(t, err)
+}
+
+func TestArrayOperators(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[DeviceEntity, DeviceEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	name := uuid.NewString()
+	device := &DeviceEntity{ID: uuid.NewString(), Name: name, Tags: query.NewArrayValue([]string{"a", "b", `c "d"`})}
+	countDevices := createFixtures(t, r, map[string]any{"name": map[string]any{"eq": name}},
+		device,
+		&DeviceEntity{ID: uuid.NewString(), Name: name, Tags: query.NewArrayValue([]string{"b"})},
+		&DeviceEntity{ID: uuid.NewString(), Name: name, Tags: query.NewArrayValue([]string{})},
+	)
+	count := func(tags map[string]any) int64 {
+		return countDevices(map[string]any{"tags": tags})
+	}
+
+	assert.Equal(t, int64(1), count(map[string]any{"arrayContains": []string{"a", `c "d"`}}))
+	assert.Equal(t, int64(2), count(map[string]any{"arrayContains": "b"}))
+	assert.Equal(t, int64(2), count(map[string]any{"arrayContainedBy": []string{"b", "x"}}))
+	assert.Equal(t, int64(2), count(map[string]any{"arrayOverlaps": []string{"a", "b"}}))
+	assert.Equal(t, int64(1), count(map[string]any{"arrayLength": 0}))
+	assert.Equal(t, int64(2), count(map[string]any{"arrayLength": map[string]any{"gte": 1}}))
+	assert.Equal(t, int64(1), count(map[string]any{"anyEq": "a"}))
+
+	// 数组列可以读回
+	got, err := r.Get(c, device.ID)
+	assert.NoError(t, err)
+	if got != nil {
+		assert.Equal(t, query.ArrayValue{"a", "b", `c "d"`}, got.Tags)
+	}
+
+	devices, err := r.Query(c, &types.PageQuery{Filter: map[string]any{
+		"name": map[string]any{"eq": name},
+		"tags": map[string]any{"arrayLength": 0},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(devices))
+	if len(devices) == 1 {
+		assert.Equal(t, query.ArrayValue{}, devices[0].Tags)
+	}
+
+	assert.NoError(t, r.Delete(c, device.ID))
+	assert.Equal(t, int64(2), countDevices(nil))
+}
+
+func TestSearch(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[NoteEntity, NoteEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	author := uuid.NewString()
+	filter := map[string]any{"author": map[string]any{"eq": author}}
+	createFixtures(t, r, filter,
+		&NoteEntity{ID: uuid.NewString(), Author: author, Title: "Running shoes", Body: "The quick brown fox jumps over the lazy dog"},
+		&NoteEntity{ID: uuid.NewString(), Author: author, Title: "Foxes", Body: "Foxes and more foxes, a fox everywhere"},
+		&NoteEntity{ID: uuid.NewString(), Author: author, Title: "Cats", Body: "Nothing to see here"},
+	)
+
+	// 按相关度排序, 词干匹配 foxes -> fox
+	results, err := r.Search(c, "fox", &types.PageQuery{Filter: filter})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(results))
+	if len(results) == 2 {
+		assert.Equal(t, "Foxes", results[0].Title)
+	}
+
+	results, err = r.Search(c, "fox -lazy", &types.PageQuery{Filter: filter})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+
+	results, err = r.Search(c, "fox", &types.PageQuery{Filter: filter, Page: map[string]int{"limit": 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+
+	// search 操作符可以用于普通查询和游标查询
+	count, err := r.Count(c, &types.PageQuery{
+		Filter: map[string]any{
+			"author": map[string]any{"eq": author},
+			"title":  map[string]any{"search": "running"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	cursorResults, _, err := r.CursorQuery(c, &types.CursorQuery{
+		Filter: map[string]any{
+			"author": map[string]any{"eq": author},
+			"body":   map[string]any{"search": "fox"},
+		},
+		Limit: 10,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(cursorResults))
+
+	_, err = r.Count(c, &types.PageQuery{Filter: map[string]any{"title": map[string]any{"search": ""}}})
+	assert.Error(t, err)
+}
+
+func TestRegexOperators(t *testing.T) {
+	db := SetupDB()
+
+	r := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	country := uuid.NewString()
+	var users []*UserEntity
+	for _, name := range []string{"alice-01", "Alice-02", "bob"} {
+		users = append(users, &UserEntity{ID: uuid.NewString(), Name: name, Country: country, Birthday: time.Now()})
+	}
+	countNames := createFixtures(t, r, map[string]any{"country": map[string]any{"eq": country}}, users...)
+	count := func(name map[string]any) int64 {
+		return countNames(map[string]any{"name": name})
+	}
+
+	assert.Equal(t, int64(1), count(map[string]any{"regex": `^alice-\d+$`}))
+	assert.Equal(t, int64(2), count(map[string]any{"iregex": `^alice-\d+$`}))
+	assert.Equal(t, int64(2), count(map[string]any{"notRegex": `^alice`}))
+
+	// 错误的正则在发送到数据库之前返回错误
+	_, err := r.Count(c, &types.PageQuery{Filter: map[string]any{"name": map[string]any{"regex": "(alice"}}})
+	assert.Error(t, err)
+}
+
+func TestNotFilter(t *testing.T) {
+	db := SetupDB()
+
+	u := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+	o := repositories.NewGormCrudRepository[OrganizationEntity, OrganizationEntity, map[string]any](db)
+	m := repositories.NewGormCrudRepository[OrganizationMemberEntity, OrganizationMemberEntity, map[string]any](db)
+	p := repositories.NewGormCrudRepository[ProjectEntity, ProjectEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	projectName := uuid.NewString()
+	var projects []*ProjectEntity
+	for _, organizationName := range []string{"acme", "globex"} {
+		organization, err := o.Create(c, &OrganizationEntity{ID: uuid.NewString(), Name: organizationName})
+		assert.NoError(t, err)
+		defer o.Delete(c, organization.ID)
+
+		user, err := u.Create(c, &UserEntity{ID: uuid.NewString(), Name: uuid.NewString(), Birthday: time.Now()})
+		assert.NoError(t, err)
+		defer u.Delete(c, user.ID)
+
+		member, err := m.Create(c, &OrganizationMemberEntity{ID: uuid.NewString(), Name: organizationName, UserID: user.ID, OrganizationID: organization.ID})
+		assert.NoError(t, err)
+		defer m.Delete(c, member.ID)
+
+		project, err := p.Create(c, &ProjectEntity{ID: uuid.NewString(), Name: projectName, OwnerID: member.ID})
+		assert.NoError(t, err)
+		defer p.Delete(c, project.ID)
+		projects = append(projects, project)
+	}
+
+	// 否定关联条件时仍然需要 join 关联
+	ps, err := p.Query(c, &types.PageQuery{
+		Filter: map[string]any{
+			"name": map[string]any{"eq": projectName},
+			"not": map[string]any{
+				"owner": map[string]any{
+					"organization": map[string]any{"name": map[string]any{"eq": "acme"}},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, ps, 1)
+	if len(ps) == 1 {
+		assert.Equal(t, projects[1].ID, ps[0].ID)
+	}
+
+	// NOT (a OR b)
+	count, err := p.Count(c, &types.PageQuery{
+		Filter: map[string]any{
+			"name": map[string]any{"eq": projectName},
+			"not": map[string]any{
+				"or": []map[string]any{
+					{"owner": map[string]any{"name": map[string]any{"eq": "acme"}}},
+					{"owner": map[string]any{"name": map[string]any{"eq": "globex"}}},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+
+	// NOT (a AND b)
+	count, err = p.Count(c, &types.PageQuery{
+		Filter: map[string]any{
+			"name": map[string]any{"eq": projectName},
+			"not": map[string]any{
+				"id":    map[string]any{"eq": projects[0].ID},
+				"owner": map[string]any{"name": map[string]any{"eq": "globex"}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	_, err = p.Count(c, &types.PageQuery{Filter: map[string]any{"not": "name"}})
+	assert.Error(t, err)
+
+	// 只有一个元素的 or 与关联中的其他条件以 AND 连接
+	count, err = p.Count(c, &types.PageQuery{
+		Filter: map[string]any{
+			"name": map[string]any{"eq": projectName},
+			"owner": map[string]any{
+				"name": map[string]any{"eq": "acme"},
+				"or":   []map[string]any{{"organization": map[string]any{"name": map[string]any{"eq": "globex"}}}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+
+	// 空的 not 不会生成 NOT (NULL)
+	for path, filter := range map[string]map[string]any{
+		"filter.not":       {"not": map[string]any{}},
+		"filter.or[1].not": {"or": []map[string]any{{"name": map[string]any{"eq": projectName}}, {"not": map[string]any{"and": []map[string]any{}}}}},
+		"filter.not.not":   {"not": map[string]any{"not": map[string]any{"name": map[string]any{}}}},
+	} {
+		_, err = p.Count(c, &types.PageQuery{Filter: filter})
+		assert.ErrorIs(t, err, query.ErrInvalidFilter)
+		var filterErr *query.FilterError
+		if assert.True(t, errors.As(err, &filterErr)) {
+			assert.Equal(t, path, filterErr.Path)
+		}
+	}
+}
+
+func TestJSONDecodedFilter(t *testing.T) {
+	db := SetupDB()
+
+	u := repositories.NewGormCrudRepository[UserEntity, UserEntity, map[string]any](db)
+
+	c := context.TODO()
+
+	var users []*UserEntity
+	for i := 0; i < 3; i++ {
+		user, err := u.Create(c, &UserEntity{ID: uuid.NewString(), Name: uuid.NewString(), Birthday: time.Now()})
+		assert.NoError(t, err)
+		defer u.Delete(c, user.ID)
+		users = append(users, user)
+	}
+
+	decode := func(s string) map[string]any {
+		var filter map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(s), &filter))
+		return filter
+	}
+
+	// json 解码得到的 []interface{}, map[string]interface{}
+	us, err := u.Query(c, &types.PageQuery{
+		Filter: decode(fmt.Sprintf(`{
+			"or": [
+				{"name": {"eq": %q}},
+				{"and": [{"id": {"in": [%q, %q]}}, {"not": {"name": {"eq": %q}}}]}
+			]
+		}`, users[0].Name, users[1].ID, users[2].ID, users[2].Name)),
+	})
+	assert.NoError(t, err)
+	var ids []string
+	for _, user := range us {
+		ids = append(ids, user.ID)
+	}
+	assert.ElementsMatch(t, []string{users[0].ID, users[1].ID}, ids)
+
+	count, err := u.Count(c, &types.PageQuery{
+		Filter: decode(fmt.Sprintf(`{"or": [{"id": {"eq": %q}}, {"id": {"eq": %q}}]}`, users[0].ID, users[2].ID)),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	// 只有一个元素的 or 与同级条件以 AND 连接
+	for _, filter := range []string{
+		`{"id": {"eq": %q}, "or": [{"name": {"eq": %q}}]}`,
+		`{"and": [{"id": {"eq": %q}}, {"or": [{"name": {"eq": %q}}]}]}`,
+	} {
+		count, err = u.Count(c, &types.PageQuery{Filter: decode(fmt.Sprintf(filter, users[0].ID, users[1].Name))})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+	}
+
+	// 结构不合法时返回带路径的错误
+	_, err = u.Query(c, &types.PageQuery{
+		Filter: decode(`{"or": [{"name": {"eq": "a"}}, {"name": {"eq": "b"}}, {"age": 5}]}`),
+	})
+	assert.ErrorIs(t, err, query.ErrInvalidFilter)
+	var filterErr *query.FilterError
+	if assert.True(t, errors.As(err, &filterErr)) {
+		assert.Equal(t, "filter.or[2].age", filterErr.Path)
+	}
+
+	_, err = u.Query(c, &types.PageQuery{Filter: decode(`{"and": {"name": {"eq": "a"}}}`)})
+	assert.ErrorIs(t, err, query.ErrInvalidFilter)
+
+	_, err = u.Query(c, &types.PageQuery{Filter: decode(`{"identities": {"some": [1]}}`)})
+	assert.ErrorIs(t, err, query.ErrInvalidFilter)
+
+	_, err = u.DeleteMany(c, decode(`{"or": [{"id": {"eq": "a"}}, {"id": "a"}]}`))
+	assert.ErrorIs(t, err, query.ErrInvalidFilter)
+
+	// 操作符的值不合法时同样返回带路径的错误
+	for path, filter := range map[string]string{
+		"filter.or[1].age.between":                 `{"or": [{}, {"age": {"between": 5}}]}`,
+		"filter.and[0].name.regex":                 `{"and": [{"name": {"regex": "("}}]}`,
+		"filter.name.isNull":                       `{"name": {"isNull": "yes"}}`,
+		"filter.not.name.is":                       `{"not": {"name": {"is": 1}}}`,
+		"filter.identities.some.provider.notExist": `{"identities": {"some": {"provider": {"notExist": 1}}}}`,
+	} {
+		_, err = u.Count(c, &types.PageQuery{Filter: decode(filter)})
+		assert.ErrorIs(t, err, query.ErrInvalidFilter)
+		if assert.True(t, errors.As(err, &filterErr)) {
+			assert.Equal(t, path, filterErr.Path)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+
+	"github.com/duolacloud/crud-core-gorm/query"
+)
+
+var ErrEmptyFilter = errors.New("empty filter, use WithAllowEmptyFilter to operate on the whole table")
+
+type allowEmptyFilterKey struct{}
+
+// WithAllowEmptyFilter 显式允许 UpdateMany / DeleteMany 在空过滤条件下作用于全表
+func WithAllowEmptyFilter(c context.Context) context.Context {
+	return context.WithValue(c, allowEmptyFilterKey{}, true)
+}
+
+func allowEmptyFilter(c context.Context) bool {
+	allow, _ := c.Value(allowEmptyFilterKey{}).(bool)
+	return allow
+}
+
+type UpsertOptions struct {
+	ConflictColumns    []string
+	ConflictIndex      string
+	ConflictConstraint string
+	UpdateColumns      []string
+	DoNothing          bool
+	CreateBatchSize    int
+}
+
+type UpsertOption func(*UpsertOptions)
+
+// WithConflictColumns 指定冲突判定的列, 默认为主键
+func WithConflictColumns(columns ...string) UpsertOption {
+	return func(o *UpsertOptions) {
+		o.ConflictColumns = columns
+	}
+}
+
+// WithConflictIndex 使用 schema 中声明的唯一索引的列作为冲突判定
+func WithConflictIndex(name string) UpsertOption {
+	return func(o *UpsertOptions) {
+		o.ConflictIndex = name
+	}
+}
+
+// WithConflictConstraint 使用数据库中的约束名作为冲突判定 (ON CONFLICT ON CONSTRAINT)
+func WithConflictConstraint(name string) UpsertOption {
+	return func(o *UpsertOptions) {
+		o.ConflictConstraint = name
+	}
+}
+
+// WithUpdateColumns 冲突时需要覆盖的列, 默认覆盖除主键外的所有列
+func WithUpdateColumns(columns ...string) UpsertOption {
+	return func(o *UpsertOptions) {
+		o.UpdateColumns = columns
+	}
+}
+
+// WithDoNothing 冲突时忽略, 不做更新
+func WithDoNothing(v bool) UpsertOption {
+	return func(o *UpsertOptions) {
+		o.DoNothing = v
+	}
+}
+
+func WithUpsertBatchSize(v int) UpsertOption {
+	return func(o *UpsertOptions) {
+		o.CreateBatchSize = v
+	}
+}
+
+type expectedVersionKey struct{}
+
+// WithExpectedVersion 指定 Update / Delete 期望的版本号, 与当前版本不一致时返回 ErrVersionConflict
+func WithExpectedVersion(c context.Context, version any) context.Context {
+	return context.WithValue(c, expectedVersionKey{}, version)
+}
+
+func expectedVersionFromContext(c context.Context) (any, bool) {
+	version := c.Value(expectedVersionKey{})
+	return version, version != nil
+}
+
+type fieldsKey struct{}
+
+// WithFields 指定 Get / QueryOne 只查询的列, Query / CursorQuery 使用查询参数中的 Fields
+func WithFields(c context.Context, fields ...string) context.Context {
+	return context.WithValue(c, fieldsKey{}, fields)
+}
+
+func fieldsFromContext(c context.Context) []string {
+	fields, _ := c.Value(fieldsKey{}).([]string)
+	return fields
+}
+
+type includesKey struct{}
+
+// WithIncludes 指定 Get / Query / QueryOne / CursorQuery 需要预加载的关联
+func WithIncludes(c context.Context, includes ...query.Include) context.Context {
+	return context.WithValue(c, includesKey{}, includes)
+}
+
+func includesFromContext(c context.Context) []query.Include {
+	includes, _ := c.Value(includesKey{}).([]query.Include)
+	return includes
+}
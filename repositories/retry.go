@@ -0,0 +1,97 @@
+package repositories
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy 可重试错误 (序列化失败, 死锁) 的重试策略, 使用带抖动的指数退避
+type RetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter 退避时间的随机浮动比例, 取值 0~1
+	Jitter float64
+}
+
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxRetries:     3,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+func (p *RetryPolicy) backoff(retries int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(retries))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+
+	if p.Jitter > 0 {
+		backoff += backoff * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(backoff)
+}
+
+// RetryStats 记录重试次数, 通过 WithRetryStats 传入
+type RetryStats struct {
+	Retries int
+}
+
+type retryStatsKey struct{}
+
+func WithRetryStats(c context.Context, stats *RetryStats) context.Context {
+	return context.WithValue(c, retryStatsKey{}, stats)
+}
+
+func retryStatsFromContext(c context.Context) *RetryStats {
+	stats, _ := c.Value(retryStatsKey{}).(*RetryStats)
+	return stats
+}
+
+// IsRetryable 判断错误是否可以通过重试解决, 即序列化失败和死锁
+func IsRetryable(err error) bool {
+	dbErr := classifyError(err)
+	if dbErr == nil {
+		return false
+	}
+	return dbErr.Kind == ErrorKindSerializationFailure || dbErr.Kind == ErrorKindDeadlock
+}
+
+func retry(c context.Context, policy *RetryPolicy, fn func() error) error {
+	if policy == nil {
+		return fn()
+	}
+
+	stats := retryStatsFromContext(c)
+
+	for retries := 0; ; retries++ {
+		err := fn()
+		if err == nil || retries >= policy.MaxRetries || !IsRetryable(err) {
+			return err
+		}
+
+		if stats != nil {
+			stats.Retries++
+		}
+
+		timer := time.NewTimer(policy.backoff(retries))
+		select {
+		case <-c.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
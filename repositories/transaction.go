@@ -0,0 +1,86 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/duolacloud/crud-core/datasource"
+	"gorm.io/gorm"
+)
+
+type TransactionOptions struct {
+	Isolation   sql.IsolationLevel
+	ReadOnly    bool
+	RetryPolicy *RetryPolicy
+}
+
+type TransactionOption func(*TransactionOptions)
+
+// WithIsolationLevel 指定事务隔离级别, 嵌套事务沿用外层事务的隔离级别
+func WithIsolationLevel(v sql.IsolationLevel) TransactionOption {
+	return func(o *TransactionOptions) {
+		o.Isolation = v
+	}
+}
+
+func WithReadOnly(v bool) TransactionOption {
+	return func(o *TransactionOptions) {
+		o.ReadOnly = v
+	}
+}
+
+// WithTransactionRetryPolicy 事务因序列化失败或死锁失败时, 重新执行整个事务, 嵌套事务不重试
+func WithTransactionRetryPolicy(policy *RetryPolicy) TransactionOption {
+	return func(o *TransactionOptions) {
+		o.RetryPolicy = policy
+	}
+}
+
+type transactionKey struct{}
+
+// RunInTransaction 在事务中执行 fn, 使用 fn 收到的 context 调用的 GormCrudRepository 都会使用同一个事务
+// fn 返回 error 或者 panic 时回滚, context 中已经存在事务时, 以 savepoint 的方式嵌套
+func RunInTransaction(c context.Context, ds datasource.DataSource[gorm.DB], fn func(c context.Context) error, opts ...TransactionOption) error {
+	var _opts TransactionOptions
+	for _, o := range opts {
+		o(&_opts)
+	}
+
+	db, nested := TransactionFromContext(c)
+	if !nested {
+		var err error
+		db, err = ds.GetDB(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	var txOptions []*sql.TxOptions
+	if !nested && (_opts.Isolation != sql.LevelDefault || _opts.ReadOnly) {
+		txOptions = append(txOptions, &sql.TxOptions{
+			Isolation: _opts.Isolation,
+			ReadOnly:  _opts.ReadOnly,
+		})
+	}
+
+	runTransaction := func() error {
+		return db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+			return fn(ContextWithTransaction(c, tx))
+		}, txOptions...)
+	}
+
+	if nested {
+		return runTransaction()
+	}
+	return retry(c, _opts.RetryPolicy, runTransaction)
+}
+
+// ContextWithTransaction 将事务绑定到 context, 一般使用 RunInTransaction 即可
+func ContextWithTransaction(c context.Context, tx *gorm.DB) context.Context {
+	return context.WithValue(c, transactionKey{}, tx)
+}
+
+func TransactionFromContext(c context.Context) (*gorm.DB, bool) {
+	tx, ok := c.Value(transactionKey{}).(*gorm.DB)
+	return tx, ok && tx != nil
+}
@@ -0,0 +1,98 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+var ErrVersionConflict = errors.New("version conflict")
+
+var updateSchemaCache = &sync.Map{}
+
+// versionField 返回乐观锁的版本字段, 通过 WithVersionField 或者 `gorm:"version"` 声明
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) versionField() (*schema.Field, error) {
+	if len(r.Options.VersionField) > 0 {
+		field := r.Schema.LookUpField(r.Options.VersionField)
+		if field == nil {
+			return nil, fmt.Errorf("version field %s not found", r.Options.VersionField)
+		}
+		return field, nil
+	}
+
+	for _, field := range r.Schema.Fields {
+		if _, ok := field.TagSettings["VERSION"]; ok && len(field.DBName) > 0 {
+			return field, nil
+		}
+	}
+	return nil, nil
+}
+
+// versionedUpdates 将 updateDTO 转换为 map, 取出期望的版本号, 并追加版本字段的递增
+// 期望的版本号优先取 WithExpectedVersion, 其次取 updateDTO 中的版本字段
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) versionedUpdates(c context.Context, versionField *schema.Field, updateDTO *UpdateDTO) (map[string]any, any, error) {
+	updates := map[string]any{}
+
+	rv := reflect.Indirect(reflect.ValueOf(updateDTO))
+	switch rv.Kind() {
+	case reflect.Map:
+		iter := rv.MapRange()
+		for iter.Next() {
+			updates[fmt.Sprint(iter.Key().Interface())] = iter.Value().Interface()
+		}
+	case reflect.Struct:
+		updateSchema, err := schema.Parse(updateDTO, updateSchemaCache, schema.NamingStrategy{})
+		if err != nil {
+			return nil, nil, err
+		}
+		// 与 gorm Updates(struct) 一致, 忽略零值字段
+		for _, field := range updateSchema.Fields {
+			if len(field.DBName) == 0 || !field.Updatable {
+				continue
+			}
+			if value, isZero := field.ValueOf(c, rv); !isZero {
+				updates[field.DBName] = value
+			}
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported update value type %s", rv.Type())
+	}
+
+	expectedVersion, hasExpectedVersion := expectedVersionFromContext(c)
+	for _, key := range []string{versionField.DBName, versionField.Name} {
+		if value, ok := updates[key]; ok {
+			if !hasExpectedVersion {
+				expectedVersion, hasExpectedVersion = value, true
+			}
+			delete(updates, key)
+		}
+	}
+
+	if versionField.DataType == schema.Time {
+		updates[versionField.DBName] = time.Now()
+	} else {
+		updates[versionField.DBName] = gorm.Expr("? + 1", clause.Column{Name: versionField.DBName})
+	}
+
+	return updates, expectedVersion, nil
+}
+
+// conflictOrNotFound 带版本条件的写入未命中时, 区分记录不存在和版本冲突
+func (r *GormCrudRepository[DTO, CreateDTO, UpdateDTO]) conflictOrNotFound(c context.Context, db *gorm.DB, filter map[string]any) error {
+	var dto DTO
+	var count int64
+	if err := db.Model(&dto).WithContext(c).Where(filter).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrVersionConflict
+	}
+	return gorm.ErrRecordNotFound
+}